@@ -1,2 +1,2 @@
 #!/bin/sh
-env GOOS=linux GOARCH=arm go build
\ No newline at end of file
+env GOOS=linux GOARCH=arm go build -ldflags "-X main.version=$(git describe --tags --always)"
\ No newline at end of file
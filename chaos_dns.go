@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	dnsScale    = "scale"
+	dnsDelete   = "delete"
+	dnsCorefile = "corefile"
+)
+
+type DNSConfiguration struct {
+	Enabled     bool              `yaml:"enabled"`
+	Interval    time.Duration     `yaml:"interval"`
+	Duration    time.Duration     `yaml:"duration"`
+	Mode        string            `yaml:"mode"`
+	Namespace   string            `yaml:"namespace"`
+	Deployment  string            `yaml:"deployment"`
+	ConfigMap   string            `yaml:"configMap"`
+	Selector    map[string]string `yaml:"selector"`
+	MinReplicas int               `yaml:"minReplicas"`
+	Domains     []string          `yaml:"domains"`
+	Failure     string            `yaml:"failure"`
+	Delay       time.Duration     `yaml:"delay"`
+	DelayListen string            `yaml:"delayListen"`
+	DelayProxy  string            `yaml:"delayProxy"`
+	Upstream    string            `yaml:"upstream"`
+}
+
+func withDNSDefaults(dnsConfig DNSConfiguration) DNSConfiguration {
+	if dnsConfig.Mode == "" {
+		dnsConfig.Mode = dnsDelete
+	}
+	if dnsConfig.Namespace == "" {
+		dnsConfig.Namespace = "kube-system"
+	}
+	if dnsConfig.Deployment == "" {
+		dnsConfig.Deployment = "coredns"
+	}
+	if dnsConfig.ConfigMap == "" {
+		dnsConfig.ConfigMap = "coredns"
+	}
+	if len(dnsConfig.Selector) == 0 {
+		dnsConfig.Selector = map[string]string{"k8s-app": "kube-dns"}
+	}
+	if dnsConfig.Failure == "" {
+		dnsConfig.Failure = "nxdomain"
+	}
+	if dnsConfig.Delay <= 0 {
+		dnsConfig.Delay = 2 * time.Second
+	}
+	if dnsConfig.DelayListen == "" {
+		dnsConfig.DelayListen = ":5353"
+	}
+	// CoreDNS only forwards to IP addresses, the pod IP comes from the downward API
+	if _, port, err := net.SplitHostPort(dnsConfig.DelayListen); dnsConfig.DelayProxy == "" && err == nil && os.Getenv("POD_IP") != "" {
+		dnsConfig.DelayProxy = net.JoinHostPort(os.Getenv("POD_IP"), port)
+	}
+	if dnsConfig.Duration <= 0 {
+		dnsConfig.Duration = time.Minute
+	}
+	// Never take the cluster DNS down entirely
+	if dnsConfig.MinReplicas < 1 {
+		dnsConfig.MinReplicas = 1
+	}
+	return dnsConfig
+}
+
+// injectDNSFailure adds a failure for the domains to a Corefile. NXDOMAIN and SERVFAIL answers are
+// served by the template plugin of the main server block. Delays need a separate server block forwarding
+// the domains to the delaying proxy, as CoreDNS runs its plugins in a fixed order, forward before erratic.
+func injectDNSFailure(corefile string, domains []string, failure string, delayProxy string) (result string, err error) {
+	if len(domains) == 0 {
+		return corefile, fmt.Errorf("no domains to inject a DNS failure for")
+	}
+	switch failure {
+	case "nxdomain", "servfail":
+		start := strings.Index(corefile, ".:53 {")
+		if start < 0 {
+			return corefile, fmt.Errorf("main server block .:53 not found in the Corefile")
+		}
+		end := start + len(".:53 {")
+		template := fmt.Sprintf("\n    template ANY ANY %s {\n        rcode %s\n    }", strings.Join(domains, " "), strings.ToUpper(failure))
+		return corefile[:end] + template + corefile[end:], nil
+	case "delay":
+		if delayProxy == "" {
+			return corefile, fmt.Errorf("no delayProxy address for CoreDNS to forward the delayed domains to")
+		}
+		zones := []string{}
+		for _, domain := range domains {
+			zones = append(zones, domain+":53")
+		}
+		return fmt.Sprintf("%s\n%s {\n    forward . %s {\n        prefer_udp\n    }\n}\n", corefile, strings.Join(zones, " "), delayProxy), nil
+	}
+	return corefile, fmt.Errorf("unknown DNS failure %s", failure)
+}
+
+// corefileUpstream finds the resolver the main server block forwards to, when it is an IP address
+func corefileUpstream(corefile string) (upstream string, err error) {
+	start := strings.Index(corefile, ".:53 {")
+	if start < 0 {
+		return "", fmt.Errorf("main server block .:53 not found in the Corefile")
+	}
+	for _, line := range strings.Split(corefile[start:], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "forward" || fields[1] != "." {
+			continue
+		}
+		if net.ParseIP(fields[2]) != nil {
+			return net.JoinHostPort(fields[2], "53"), nil
+		}
+		if _, _, err := net.SplitHostPort(fields[2]); err == nil {
+			return fields[2], nil
+		}
+		return "", fmt.Errorf("the Corefile forwards to %s, set upstream", fields[2])
+	}
+	return "", fmt.Errorf("no forward found in the Corefile, set upstream")
+}
+
+// exchangeDNS sends a raw DNS query to a resolver over UDP and returns its raw answer
+func exchangeDNS(upstream string, query []byte, timeout time.Duration) (answer []byte, err error) {
+	conn, err := net.DialTimeout("udp", upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	answer = make([]byte, 65535)
+	n, err := conn.Read(answer)
+	if err != nil {
+		return nil, err
+	}
+	return answer[:n], nil
+}
+
+// serveDelayedDNS answers every query received on a UDP socket with the answer of the upstream resolver, after a delay.
+// It stops when the socket is closed.
+func serveDelayedDNS(conn net.PacketConn, upstream string, delay time.Duration) {
+	buffer := make([]byte, 65535)
+	for true {
+		n, client, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buffer[:n]...)
+		go func() {
+			time.Sleep(delay)
+			answer, err := exchangeDNS(upstream, query, 5*time.Second)
+			if err != nil {
+				log.Printf("ERROR: Cannot forward a delayed DNS query to %s: %v\n", upstream, err)
+				return
+			}
+			conn.WriteTo(answer, client)
+		}()
+	}
+}
+
+func scaleDownDNS(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset, dnsConfig DNSConfiguration) {
+	deployment, err := clientset.AppsV1().Deployments(dnsConfig.Namespace).Get(ctx, dnsConfig.Deployment, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot get the DNS deployment %s.%s: %v\n", dnsConfig.Namespace, dnsConfig.Deployment, err)
+		return
+	}
+	if allowed, _ := checkGuardrails(ctx, clientset, testPlan.Safety, "deployment", deployment); !allowed {
+		return
+	}
+	replicas := int(*deployment.Spec.Replicas)
+	if replicas <= dnsConfig.MinReplicas {
+		log.Printf("DNS deployment %s.%s already runs %d replicas, the floor is %d.\n", dnsConfig.Namespace, dnsConfig.Deployment, replicas, dnsConfig.MinReplicas)
+		return
+	}
+
+	entry := undoEntry{Kind: undoScale, Namespace: dnsConfig.Namespace, Name: dnsConfig.Deployment, Data: map[string]string{"kind": "Deployment", "replicas": strconv.Itoa(replicas)}}
+	id := journal.record(entry.Kind, entry.Namespace, entry.Name, entry.Data)
+	defer restoreJournaled(ctx, clientset, id, entry)
+
+	log.Printf("Scaling the DNS deployment %s.%s from %d down to %d replicas for %s\n", dnsConfig.Namespace, dnsConfig.Deployment, replicas, dnsConfig.MinReplicas, dnsConfig.Duration)
+	err = scaleWorkload(ctx, clientset, dnsConfig.Namespace, "Deployment", dnsConfig.Deployment, dnsConfig.MinReplicas)
+	if err != nil {
+		log.Printf("ERROR: Cannot scale the DNS deployment %s.%s: %v\n", dnsConfig.Namespace, dnsConfig.Deployment, err)
+		return
+	}
+	reportDisruption(testPlan, disruptionEvent{Action: "dns scale down", Objects: []string{dnsConfig.Namespace + "." + dnsConfig.Deployment}, Global: true})
+	sleepUnlessPaused(dnsConfig.Duration)
+}
+
+func deleteDNSPods(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset, dnsConfig DNSConfiguration) {
+	pods, err := clientset.CoreV1().Pods(dnsConfig.Namespace).List(ctx, labelSelectors(dnsConfig.Selector))
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of DNS pods: %v\n", err)
+		return
+	}
+	available := 0
+	candidates := []v1.Pod{}
+	for _, pod := range pods.Items {
+		if isPodAvailable(pod) {
+			available++
+			if allowed, _ := checkGuardrails(ctx, clientset, testPlan.Safety, "pod", &pod); allowed {
+				candidates = append(candidates, pod)
+			}
+		}
+	}
+
+	disrupted := []disruptedPod{}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	for _, pod := range candidates {
+		if available <= dnsConfig.MinReplicas {
+			log.Printf("Keeping the remaining %d DNS pods, the floor is %d.\n", available, dnsConfig.MinReplicas)
+			break
+		}
+		log.Printf("Deleting DNS pod %s.%s\n", pod.Namespace, pod.Name)
+		err = clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, *metav1.NewDeleteOptions(0))
+		if err != nil {
+			log.Printf("ERROR: Cannot delete a pod %s.%s: %v\n", pod.Namespace, pod.Name, err)
+			continue
+		}
+		available--
+		disrupted = append(disrupted, disruptedPod{Name: pod.Name, Labels: pod.Labels, Node: pod.Spec.NodeName})
+	}
+	if len(disrupted) > 0 {
+		reportDisruption(testPlan, disruptionEvent{Action: "dns pod deletion", Namespace: dnsConfig.Namespace, Pods: disrupted, Global: true})
+	}
+}
+
+func injectCorefileFailure(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset, dnsConfig DNSConfiguration) {
+	configMap, err := clientset.CoreV1().ConfigMaps(dnsConfig.Namespace).Get(ctx, dnsConfig.ConfigMap, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot get the DNS config map %s.%s: %v\n", dnsConfig.Namespace, dnsConfig.ConfigMap, err)
+		return
+	}
+	if allowed, _ := checkGuardrails(ctx, clientset, testPlan.Safety, "configmap", configMap); !allowed {
+		return
+	}
+	original := configMap.Data["Corefile"]
+	corefile, err := injectDNSFailure(original, dnsConfig.Domains, dnsConfig.Failure, dnsConfig.DelayProxy)
+	if err != nil {
+		log.Printf("ERROR: Cannot inject a DNS failure: %v\n", err)
+		return
+	}
+	if dnsConfig.Failure == "delay" {
+		upstream := dnsConfig.Upstream
+		if upstream == "" {
+			upstream, err = corefileUpstream(original)
+			if err != nil {
+				log.Printf("ERROR: Cannot find the upstream resolver for delayed DNS queries: %v\n", err)
+				return
+			}
+		}
+		conn, err := net.ListenPacket("udp", dnsConfig.DelayListen)
+		if err != nil {
+			log.Printf("ERROR: Cannot listen for delayed DNS queries on %s: %v\n", dnsConfig.DelayListen, err)
+			return
+		}
+		// Closed once the Corefile is restored, the deferred restore runs first
+		defer conn.Close()
+		go serveDelayedDNS(conn, upstream, dnsConfig.Delay)
+	}
+
+	entry := undoEntry{Kind: undoConfigMap, Namespace: dnsConfig.Namespace, Name: dnsConfig.ConfigMap, Data: map[string]string{"key": "Corefile", "value": original}}
+	id := journal.record(entry.Kind, entry.Namespace, entry.Name, entry.Data)
+	defer restoreJournaled(ctx, clientset, id, entry)
+
+	log.Printf("Injecting %s for %s into %s.%s for %s\n", dnsConfig.Failure, strings.Join(dnsConfig.Domains, ", "), dnsConfig.Namespace, dnsConfig.ConfigMap, dnsConfig.Duration)
+	err = patchConfigMapKey(ctx, clientset, dnsConfig.Namespace, dnsConfig.ConfigMap, "Corefile", corefile)
+	if err != nil {
+		log.Printf("ERROR: Cannot update the DNS config map %s.%s: %v\n", dnsConfig.Namespace, dnsConfig.ConfigMap, err)
+		return
+	}
+	reportDisruption(testPlan, disruptionEvent{Action: "dns " + dnsConfig.Failure, Objects: dnsConfig.Domains, Global: true})
+	sleepUnlessPaused(dnsConfig.Duration)
+}
+
+func disruptDNSOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	dnsConfig := withDNSDefaults(testPlan.Disruption.DNS)
+	switch dnsConfig.Mode {
+	case dnsScale:
+		scaleDownDNS(ctx, testPlan, clientset, dnsConfig)
+	case dnsDelete:
+		deleteDNSPods(ctx, testPlan, clientset, dnsConfig)
+	case dnsCorefile:
+		injectCorefileFailure(ctx, testPlan, clientset, dnsConfig)
+	default:
+		log.Printf("ERROR: Unknown DNS disruption mode %s.\n", dnsConfig.Mode)
+	}
+}
+
+func disruptDNS(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("dns", func() { disruptDNSOnce(ctx, testPlan, clientset) })
+
+	for true {
+		waitForSchedule(testPlan, "DNS disruptor")
+		disruptors.run("dns")
+
+		duration := time.Duration(rand.Int63n(testPlan.Disruption.DNS.Interval.Nanoseconds())) * time.Nanosecond
+		log.Printf("For next DNS disruption sleeping for %s\n", duration)
+		disruptors.sleep("dns", duration)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	controllerRestart = "restart"
+	controllerReload  = "reload"
+)
+
+// Annotation marking the default IngressClass of a cluster
+const defaultIngressClassAnnotation = "ingressclass.kubernetes.io/is-default-class"
+
+// Pod labels of the well known ingress controllers, by their IngressClass controller name
+var controllerSelectors = map[string]map[string]string{
+	"k8s.io/ingress-nginx":                   {"app.kubernetes.io/name": "ingress-nginx", "app.kubernetes.io/component": "controller"},
+	"traefik.io/ingress-controller":          {"app.kubernetes.io/name": "traefik"},
+	"haproxy.org/ingress-controller/haproxy": {"app.kubernetes.io/name": "kubernetes-ingress"},
+}
+
+// Commands forcing a configuration reload in the first container of the controllers supporting it
+var controllerReloadCommands = map[string][]string{
+	"k8s.io/ingress-nginx": {"nginx", "-s", "reload"},
+}
+
+type IngressControllerConfiguration struct {
+	Enabled       bool              `yaml:"enabled"`
+	Interval      time.Duration     `yaml:"interval"`
+	Mode          string            `yaml:"mode"`
+	IngressClass  string            `yaml:"ingressClass"`
+	Namespace     string            `yaml:"namespace"`
+	Selector      map[string]string `yaml:"selector"`
+	AllReplicas   bool              `yaml:"allReplicas"`
+	Timeout       time.Duration     `yaml:"timeout"`
+	ReloadCommand []string          `yaml:"reloadCommand"`
+}
+
+func withControllerDefaults(controllerConfig IngressControllerConfiguration) IngressControllerConfiguration {
+	if controllerConfig.Mode == "" {
+		controllerConfig.Mode = controllerRestart
+	}
+	if controllerConfig.Timeout <= 0 {
+		controllerConfig.Timeout = 5 * time.Minute
+	}
+	return controllerConfig
+}
+
+// controllerSelector picks the IngressClass by name, or the default one, and maps its controller to pod labels
+func controllerSelector(classes []networkingv1.IngressClass, className string) (selector map[string]string, err error) {
+	class, err := findIngressClass(classes, className)
+	if err != nil {
+		return nil, err
+	}
+	selector, found := controllerSelectors[class.Spec.Controller]
+	if !found {
+		return nil, fmt.Errorf("unknown ingress controller %s of class %s, set a selector", class.Spec.Controller, class.Name)
+	}
+	return selector, nil
+}
+
+func findIngressClass(classes []networkingv1.IngressClass, className string) (class *networkingv1.IngressClass, err error) {
+	for i := range classes {
+		if classes[i].Name == className || (className == "" && classes[i].Annotations[defaultIngressClassAnnotation] == "true") {
+			class = &classes[i]
+			break
+		}
+	}
+	if class == nil && className == "" && len(classes) == 1 {
+		class = &classes[0]
+	}
+	if class == nil {
+		return nil, fmt.Errorf("ingress class %q not found, set a selector", className)
+	}
+	return class, nil
+}
+
+// reloadCommand is the configured reload command, or the one of the auto-detected controller
+func reloadCommand(controllerConfig IngressControllerConfiguration, controller string) (command []string, err error) {
+	if len(controllerConfig.ReloadCommand) > 0 {
+		return controllerConfig.ReloadCommand, nil
+	}
+	command, found := controllerReloadCommands[controller]
+	if !found {
+		if controller == "" {
+			return nil, fmt.Errorf("the controller found by selector has no known reload command, set reloadCommand")
+		}
+		return nil, fmt.Errorf("ingress controller %s has no known reload command, set reloadCommand", controller)
+	}
+	return command, nil
+}
+
+// findControllerPods lists the controller pods, along with the controller name when it is auto-detected
+func findControllerPods(ctx context.Context, clientset *kubernetes.Clientset, controllerConfig IngressControllerConfiguration) (pods []v1.Pod, controller string, err error) {
+	selector := controllerConfig.Selector
+	if len(selector) == 0 {
+		classes, err := clientset.NetworkingV1().IngressClasses().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, "", err
+		}
+		class, err := findIngressClass(classes.Items, controllerConfig.IngressClass)
+		if err != nil {
+			return nil, "", err
+		}
+		selector, err = controllerSelector(classes.Items, class.Name)
+		if err != nil {
+			return nil, "", err
+		}
+		controller = class.Spec.Controller
+	}
+	list, err := clientset.CoreV1().Pods(controllerConfig.Namespace).List(ctx, labelSelectors(selector))
+	if err != nil {
+		return nil, "", err
+	}
+	return list.Items, controller, nil
+}
+
+// waitForControllerReplacement waits until the controller has as many ready pods as before the restart
+func waitForControllerReplacement(ctx context.Context, clientset *kubernetes.Clientset, controllerConfig IngressControllerConfiguration, restarted v1.Pod, ready int) bool {
+	deadline := time.Now().Add(controllerConfig.Timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		pods, _, err := findControllerPods(ctx, clientset, controllerConfig)
+		if err != nil {
+			log.Printf("ERROR: Cannot get a list of ingress controller pods: %v\n", err)
+			continue
+		}
+		available := 0
+		for _, pod := range pods {
+			if pod.UID != restarted.UID && isPodAvailable(pod) {
+				available++
+			}
+		}
+		if available >= ready {
+			return true
+		}
+	}
+	return false
+}
+
+func disruptIngressControllerOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	controllerConfig := withControllerDefaults(testPlan.Disruption.IngressController)
+	pods, controller, err := findControllerPods(ctx, clientset, controllerConfig)
+	if err != nil {
+		log.Printf("ERROR: Cannot find the ingress controller pods: %v\n", err)
+		return
+	}
+	var command []string
+	if controllerConfig.Mode == controllerReload {
+		command, err = reloadCommand(controllerConfig, controller)
+		if err != nil {
+			log.Printf("ERROR: Refusing to reload the ingress controller: %v\n", err)
+			return
+		}
+	}
+	ready := 0
+	candidates := []v1.Pod{}
+	for _, pod := range pods {
+		if !isPodAvailable(pod) {
+			continue
+		}
+		ready++
+		if allowed, _ := checkGuardrails(ctx, clientset, testPlan.Safety, "pod", &pod); allowed {
+			candidates = append(candidates, pod)
+		}
+	}
+	if ready < len(pods) {
+		log.Printf("Ingress controller is degraded, %d of %d pods ready. Skipping for now.\n", ready, len(pods))
+		return
+	}
+	if len(candidates) == 0 {
+		log.Println("No ingress controller pods eligible for disruption.")
+		return
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if !controllerConfig.AllReplicas {
+		candidates = candidates[:1]
+	}
+
+	for _, pod := range candidates {
+		// Replicas are disrupted one at a time for minutes, a pause stops the remaining ones
+		if killSwitch.isPaused() {
+			log.Println("Kill switch: paused, leaving the remaining ingress controller pods alone.")
+			return
+		}
+		disrupted := []disruptedPod{{Name: pod.Name, Labels: pod.Labels, Node: pod.Spec.NodeName}}
+		switch controllerConfig.Mode {
+		case controllerRestart:
+			log.Printf("Restarting ingress controller pod %s.%s\n", pod.Namespace, pod.Name)
+			err = clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			if err != nil {
+				log.Printf("ERROR: Cannot delete a pod %s.%s: %v\n", pod.Namespace, pod.Name, err)
+				return
+			}
+			recordDisruption(podGroup(pod))
+			reportDisruption(testPlan, disruptionEvent{Action: "ingress controller restart", Namespace: pod.Namespace, Pods: disrupted, Global: true})
+			// One replica at a time, the next one is restarted once the replacement is ready
+			if !waitForControllerReplacement(ctx, clientset, controllerConfig, pod, ready) {
+				log.Printf("ERROR: Ingress controller didn't recover within %s.\n", controllerConfig.Timeout)
+				return
+			}
+		case controllerReload:
+			log.Printf("Reloading the configuration of ingress controller pod %s.%s\n", pod.Namespace, pod.Name)
+			err = execInContainer(ctx, clientset, pod, pod.Spec.Containers[0].Name, command)
+			if err != nil {
+				log.Printf("ERROR: Cannot reload ingress controller pod %s.%s: %v\n", pod.Namespace, pod.Name, err)
+				return
+			}
+			recordDisruption(podGroup(pod))
+			reportDisruption(testPlan, disruptionEvent{Action: "ingress controller reload", Namespace: pod.Namespace, Pods: disrupted, Global: true})
+		default:
+			log.Printf("ERROR: Unknown ingress controller disruption mode %s.\n", controllerConfig.Mode)
+			return
+		}
+	}
+}
+
+func disruptIngressController(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("ingressController", func() { disruptIngressControllerOnce(ctx, testPlan, clientset) })
+
+	for true {
+		waitForSchedule(testPlan, "ingress controller disruptor")
+		disruptors.run("ingressController")
+
+		duration := time.Duration(rand.Int63n(testPlan.Disruption.IngressController.Interval.Nanoseconds())) * time.Nanosecond
+		log.Printf("For next ingress controller disruption sleeping for %s\n", duration)
+		disruptors.sleep("ingressController", duration)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type NetworkConfiguration struct {
+	Enabled   bool          `yaml:"enabled"`
+	Interval  time.Duration `yaml:"interval"`
+	Duration  time.Duration `yaml:"duration"`
+	Direction string        `yaml:"direction"`
+	Peers     []string      `yaml:"peers"`
+}
+
+// partitionPolicy denies the traffic of the selected pods. Without peers all traffic is denied,
+// with peers (CIDRs) only the traffic to and from these peers is denied.
+func partitionPolicy(networkConfig NetworkConfiguration, namespace string, selector map[string]string) (policy *networkingv1.NetworkPolicy) {
+	policy = &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("kube-entropy-partition-%d", rand.Int31()),
+			Namespace: namespace,
+			Labels:    map[string]string{managedLabel: "true"},
+		},
+		Spec: networkingv1.NetworkPolicySpec{PodSelector: metav1.LabelSelector{MatchLabels: selector}},
+	}
+
+	var peers []networkingv1.NetworkPolicyPeer
+	if len(networkConfig.Peers) > 0 {
+		peers = []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "0.0.0.0/0", Except: networkConfig.Peers}}}
+	}
+	if networkConfig.Direction != "egress" {
+		policy.Spec.PolicyTypes = append(policy.Spec.PolicyTypes, networkingv1.PolicyTypeIngress)
+		if peers != nil {
+			policy.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{{From: peers}}
+		}
+	}
+	if networkConfig.Direction != "ingress" {
+		policy.Spec.PolicyTypes = append(policy.Spec.PolicyTypes, networkingv1.PolicyTypeEgress)
+		if peers != nil {
+			policy.Spec.Egress = []networkingv1.NetworkPolicyEgressRule{{To: peers}}
+		}
+	}
+	return policy
+}
+
+func partitionNetworkOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	networkConfig := testPlan.Disruption.Network
+	target, err := choosePodTarget(ctx, testPlan, clientset)
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of running pods. Skipping for now. %v\n", err)
+		return
+	}
+	if len(target.candidates) == 0 {
+		log.Printf("No pods eligible for a network partition for %v\n", target.endpoint.PodSelector)
+		return
+	}
+
+	// The policy selects every pod matching the selector, so every one of them has to be eligible
+	eligible := map[string]bool{}
+	for _, pod := range target.candidates {
+		eligible[pod.Name] = true
+	}
+	for _, pod := range target.selected {
+		if !eligible[pod.Name] {
+			log.Printf("Guardrail: refusing to partition %s, pod %s.%s matches the selector but can't be disrupted.\n", target.endpoint.URL, pod.Namespace, pod.Name)
+			return
+		}
+	}
+	groups := map[string]int{}
+	for _, pod := range target.candidates {
+		groups[podGroup(pod)]++
+	}
+	for group, count := range groups {
+		if budget, limited := target.budgets[group]; limited && budget < count {
+			log.Printf("Guardrail: refusing to partition %s, %d pods exceed the %d disruptions left.\n", group, count, budget)
+			return
+		}
+	}
+
+	if networkConfig.Duration <= 0 {
+		networkConfig.Duration = time.Minute
+	}
+	policy := partitionPolicy(networkConfig, target.namespace, target.endpoint.PodSelector)
+	log.Printf("Partitioning %s on %s with network policy %s.%s for %s\n", target.endpoint.Workload, target.endpoint.URL, policy.Namespace, policy.Name, networkConfig.Duration)
+	id := journal.record(undoNetworkPolicy, policy.Namespace, policy.Name, nil)
+	_, err = clientset.NetworkingV1().NetworkPolicies(policy.Namespace).Create(ctx, policy, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot create network policy %s.%s: %v\n", policy.Namespace, policy.Name, err)
+		journal.complete(id)
+		return
+	}
+
+	disrupted := []disruptedPod{}
+	for _, pod := range target.candidates {
+		recordDisruption(podGroup(pod))
+		disrupted = append(disrupted, target.disruptedPod(ctx, clientset, pod))
+	}
+	reportDisruption(testPlan, disruptionEvent{Action: "network partition", Namespace: target.namespace, Pods: disrupted})
+
+	sleepUnlessPaused(networkConfig.Duration)
+
+	log.Printf("Removing network policy %s.%s\n", policy.Namespace, policy.Name)
+	entry := undoEntry{Kind: undoNetworkPolicy, Namespace: policy.Namespace, Name: policy.Name}
+	err = undo(ctx, clientset, entry)
+	if err != nil {
+		log.Printf("ERROR: Cannot delete network policy %s.%s: %v\n", policy.Namespace, policy.Name, err)
+		return
+	}
+	journal.complete(id)
+}
+
+func partitionNetwork(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("network", func() { partitionNetworkOnce(ctx, testPlan, clientset) })
+
+	for true {
+		waitForSchedule(testPlan, "network partitioner")
+		disruptors.run("network")
+
+		duration := time.Duration(rand.Int63n(testPlan.Disruption.Network.Interval.Nanoseconds())) * time.Nanosecond
+		log.Printf("For next network partition sleeping for %s\n", duration)
+		disruptors.sleep("network", duration)
+	}
+}
@@ -2,69 +2,207 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"math/rand"
+	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
 )
 
-func killNodes(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+const (
+	nodeCordon = "cordon"
+	nodeTaint  = "taint"
+)
 
-	nodes := &v1.NodeList{}
-	var err error
-	// Attempt to get a list of all scheduleable nodes
-	for true {
-		listOptions := namedNodeSelectors(testPlan.Disruption.Nodes.Items)
-		nodes, err = clientset.CoreV1().Nodes().List(ctx, listOptions)
+// setNodeUnschedulable patches the unschedulable flag only, so the rest of the node is left to other controllers.
+// The patch sets a single field without a resourceVersion, so it never conflicts and isn't retried.
+func setNodeUnschedulable(ctx context.Context, clientset *kubernetes.Clientset, name string, unschedulable bool) (err error) {
+	patch, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"unschedulable": unschedulable}})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Nodes().Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// uncordonNodes reverts the cordons of the previous round, leaving the nodes cordoned by someone else alone
+func uncordonNodes(ctx context.Context, clientset *kubernetes.Clientset) {
+	for _, entry := range journal.pending() {
+		if entry.Kind == undoCordon {
+			restoreJournaled(ctx, clientset, entry.ID, entry)
+		}
+	}
+}
+
+func cordonNodeOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	uncordonNodes(ctx, clientset)
+
+	victims := chooseNodes(ctx, testPlan, clientset, testPlan.Disruption.Nodes, func(node v1.Node) bool { return false })
+	placement := livePlacement(ctx, clientset, testPlan)
+	cordoned, affected := []string{}, []string{}
+	for _, node := range victims {
+		log.Printf("Cordoning off %s\n", node.Name)
+		routes := routesOnNode(testPlan, placement, node.Name)
+		if len(routes) > 0 {
+			log.Printf("Expected to affect %s\n", strings.Join(routes, ", "))
+		}
+		id := journal.record(undoCordon, "", node.Name, nil)
+		err := setNodeUnschedulable(ctx, clientset, node.Name, true)
 		if err != nil {
-			log.Printf("ERROR: Cannot get a list of nodes. Skipping for now: %v\n", err)
-			time.Sleep(time.Duration(1 * time.Minute))
+			log.Printf("ERROR: Cannot cordon the node: %v\n", err)
+			journal.complete(id)
 			continue
-		} else {
-			log.Printf("%d nodes found\n", len(nodes.Items))
 		}
-		break
+		recordDisruption("node/" + node.Name)
+		cordoned = append(cordoned, node.Name)
+		affected = append(affected, routes...)
+	}
+	if len(cordoned) > 0 {
+		reportDisruption(testPlan, disruptionEvent{Action: "node cordon", Nodes: cordoned, Endpoints: affected})
 	}
+	// TODO: Drain the node
+}
+
+func killNodes(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("nodes", func() { cordonNodeOnce(ctx, testPlan, clientset) })
 
 	// Randomly make some of the node unschedulable
 	for true {
-		// Make all nodes schedulable
-		for i := 0; i < len(nodes.Items); i++ {
-			node := nodes.Items[i]
-			if node.Spec.Unschedulable == true {
-				node.Spec.Unschedulable = false
-				_, err = clientset.CoreV1().Nodes().Update(ctx, &node, metav1.UpdateOptions{})
-				if err != nil {
-					log.Printf("ERROR: Cannot uncordon the node: %v\n", err)
-				}
+		// Cordons don't outlive the round, even triggered ones while the schedule keeps the next round waiting
+		waitForScheduleIdling(testPlan, "node killer", func() {
+			disruptors.whileIdle("nodes", func() { uncordonNodes(ctx, clientset) })
+		})
+		disruptors.run("nodes")
+
+		duration := time.Duration(rand.Int63n(testPlan.Disruption.Nodes.Interval.Nanoseconds())) * time.Nanosecond
+		log.Printf("For next node cordon sleeping for %s\n", duration)
+		disruptors.sleep("nodes", duration)
+	}
+}
+
+func withTaintDefaults(nodeConfig NodeConfiguration) NodeConfiguration {
+	if nodeConfig.Taint.Key == "" {
+		nodeConfig.Taint.Key = "kube-entropy.io/disrupted"
+	}
+	if nodeConfig.Taint.Effect == "" {
+		nodeConfig.Taint.Effect = string(v1.TaintEffectNoSchedule)
+	}
+	if nodeConfig.Duration <= 0 {
+		nodeConfig.Duration = 5 * time.Minute
+	}
+	return nodeConfig
+}
+
+func hasTaint(node v1.Node, key string, effect string) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key && string(taint.Effect) == effect {
+			return true
+		}
+	}
+	return false
+}
+
+// updateNodeTaints patches the taints of a fresh copy of a node. The patch carries the resource version,
+// so a concurrent write by another controller is detected and the update retried instead of overwritten.
+func updateNodeTaints(ctx context.Context, clientset *kubernetes.Clientset, name string, mutate func(taints []v1.Taint) []v1.Taint) (err error) {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": node.ResourceVersion},
+			"spec":     map[string]interface{}{"taints": mutate(node.Spec.Taints)},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = clientset.CoreV1().Nodes().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+func addNodeTaint(ctx context.Context, clientset *kubernetes.Clientset, name string, taint v1.Taint) (err error) {
+	return updateNodeTaints(ctx, clientset, name, func(taints []v1.Taint) []v1.Taint {
+		result := []v1.Taint{}
+		for _, existing := range taints {
+			if existing.Key != taint.Key || existing.Effect != taint.Effect {
+				result = append(result, existing)
 			}
 		}
+		return append(result, taint)
+	})
+}
 
-		// And randomly unschedule one
-		randomIndex := rand.Intn(len(nodes.Items))
-		log.Printf("%d nodes found\n", len(nodes.Items))
-		if len(nodes.Items) == 1 {
-			log.Println("ERROR: Only 1 node found, cannot cordon it off.")
-		} else {
-			for i := 0; i < len(nodes.Items); i++ {
-				node := nodes.Items[i]
-				if i == randomIndex {
-					log.Printf("Cordoning off %s\n", node.Name)
-					node.Spec.Unschedulable = true
-					_, err = clientset.CoreV1().Nodes().Update(ctx, &node, metav1.UpdateOptions{})
-					if err != nil {
-						log.Printf("ERROR: Cannot cordon the node: %v\n", err)
-					}
-					// TODO: Drain the node
-				}
+func removeNodeTaint(ctx context.Context, clientset *kubernetes.Clientset, name string, key string, effect string) (err error) {
+	return updateNodeTaints(ctx, clientset, name, func(taints []v1.Taint) []v1.Taint {
+		result := []v1.Taint{}
+		for _, existing := range taints {
+			if existing.Key != key || string(existing.Effect) != effect {
+				result = append(result, existing)
 			}
 		}
+		return result
+	})
+}
+
+func taintNodeOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	nodeConfig := withTaintDefaults(testPlan.Disruption.Nodes)
+	victims := chooseNodes(ctx, testPlan, clientset, nodeConfig, func(node v1.Node) bool {
+		return hasTaint(node, nodeConfig.Taint.Key, nodeConfig.Taint.Effect)
+	})
+
+	taint := v1.Taint{Key: nodeConfig.Taint.Key, Value: nodeConfig.Taint.Value, Effect: v1.TaintEffect(nodeConfig.Taint.Effect)}
+	placement := livePlacement(ctx, clientset, testPlan)
+	tainted, affected := []string{}, []string{}
+	for _, node := range victims {
+		if killSwitch.isPaused() {
+			log.Printf("Kill switch: paused, leaving the remaining nodes alone.\n")
+			break
+		}
+		entry := undoEntry{Kind: undoTaint, Name: node.Name, Data: map[string]string{"key": taint.Key, "effect": string(taint.Effect)}}
+		id := journal.record(entry.Kind, entry.Namespace, entry.Name, entry.Data)
+		defer restoreJournaled(ctx, clientset, id, entry)
+
+		log.Printf("Tainting %s with %s:%s for %s\n", node.Name, taint.Key, taint.Effect, nodeConfig.Duration)
+		routes := routesOnNode(testPlan, placement, node.Name)
+		if len(routes) > 0 {
+			log.Printf("Expected to affect %s\n", strings.Join(routes, ", "))
+		}
+		err := addNodeTaint(ctx, clientset, node.Name, taint)
+		if err != nil {
+			log.Printf("ERROR: Cannot taint the node: %v\n", err)
+			continue
+		}
+		recordDisruption("node/" + node.Name)
+		tainted = append(tainted, node.Name)
+		affected = append(affected, routes...)
+		// A pause during the patch may have undone the journal before the taint existed, the deferred restore removes it
+		if killSwitch.isPaused() {
+			break
+		}
+	}
+	if len(tainted) > 0 {
+		reportDisruption(testPlan, disruptionEvent{Action: "node taint " + string(taint.Effect), Nodes: tainted, Endpoints: affected})
+		sleepUnlessPaused(nodeConfig.Duration)
+	}
+}
+
+func taintNodes(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("nodes", func() { taintNodeOnce(ctx, testPlan, clientset) })
+
+	for true {
+		waitForSchedule(testPlan, "node tainter")
+		disruptors.run("nodes")
 
 		duration := time.Duration(rand.Int63n(testPlan.Disruption.Nodes.Interval.Nanoseconds())) * time.Nanosecond
-		log.Printf("For next node cordon sleeping for %s\n", duration)
-		time.Sleep(duration)
+		log.Printf("For next node taint sleeping for %s\n", duration)
+		disruptors.sleep("nodes", duration)
 	}
 }
@@ -1,46 +1,506 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"strings"
 	"time"
 
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
 )
 
-func killPods(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+// podGroup identifies the workload a pod belongs to by its controller
+func podGroup(pod v1.Pod) string {
+	if owner := metav1.GetControllerOf(&pod); owner != nil {
+		return pod.Namespace + "/" + owner.Kind + "/" + owner.Name
+	}
+	return pod.Namespace + "/Pod/" + pod.Name
+}
 
-	for true {
-		ingress := testPlan.Monitoring.Ingresses.Items[rand.Intn(len(testPlan.Monitoring.Ingresses.Items))]
-		endpoint := ingress.Endpoints[rand.Intn(len(ingress.Endpoints))]
-		log.Printf("Deleting a pod on %s\n", endpoint.URL)
-		listOptions := labelSelectors(endpoint.PodSelector)
-		pods, err := clientset.CoreV1().Pods("").List(ctx, listOptions)
+func isPodAvailable(pod v1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// checkWorkloadAvailability verifies that the workload owning a pod can afford to lose it.
+// Returns how many replicas can be lost, or the reason to skip the pod.
+func checkWorkloadAvailability(ctx context.Context, clientset *kubernetes.Clientset, pod v1.Pod, minAvailable string) (budget int, reason string) {
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil {
+		return 0, "not managed by a workload"
+	}
+
+	var desired, ready int32
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet, err := clientset.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
 		if err != nil {
-			log.Printf("ERROR: Cannot get a list of running pods. Skipping for now. %v\n", err)
-		} else {
-			if pods.Items != nil && len(pods.Items) > 0 {
-				randomIndex := rand.Intn(len(pods.Items))
-				for i := 0; i < len(pods.Items); i++ {
-					if i == randomIndex {
-						log.Printf("Force deleting pod %s.%s\n", pods.Items[i].Namespace, pods.Items[i].Name)
-						err := clientset.CoreV1().Pods(pods.Items[i].Namespace).Delete(ctx, pods.Items[i].Name, *metav1.NewDeleteOptions(0))
-						if err != nil {
-							log.Printf("ERROR: Cannot delete a pod %s.%s: %v\n", pods.Items[i].Namespace, pods.Items[i].Name, err)
-						}
-					}
-				}
-			} else {
-				fmt.Printf("No pods discovered for %v", endpoint.PodSelector)
+			return 0, fmt.Sprintf("cannot get replica set %s: %v", owner.Name, err)
+		}
+		desired, ready = *replicaSet.Spec.Replicas, replicaSet.Status.ReadyReplicas
+	case "StatefulSet":
+		statefulSet, err := clientset.AppsV1().StatefulSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Sprintf("cannot get stateful set %s: %v", owner.Name, err)
+		}
+		desired, ready = *statefulSet.Spec.Replicas, statefulSet.Status.ReadyReplicas
+	default:
+		return 0, fmt.Sprintf("owned by an unsupported %s", owner.Kind)
+	}
+
+	if ready < desired {
+		return 0, fmt.Sprintf("%s %s is degraded, %d of %d replicas ready", owner.Kind, owner.Name, ready, desired)
+	}
+
+	if minAvailable == "" {
+		minAvailable = "1"
+	}
+	limit := intstr.Parse(minAvailable)
+	minimum, err := intstr.GetScaledValueFromIntOrPercent(&limit, int(desired), true)
+	if err != nil {
+		return 0, fmt.Sprintf("invalid minAvailable %s: %v", minAvailable, err)
+	}
+	if int(ready)-1 < minimum {
+		return 0, fmt.Sprintf("%s %s would drop below %d available replicas", owner.Kind, owner.Name, minimum)
+	}
+	return int(ready) - minimum, ""
+}
+
+const (
+	terminationForce       = "force"
+	terminationGraceful    = "graceful"
+	terminationGracePeriod = "gracePeriod"
+	terminationContainer   = "container"
+)
+
+// terminationFor picks the termination strategy of the first target group matching the ingress
+func terminationFor(podConfig PodConfiguration, ingress IngressState) (termination TerminationStrategy) {
+	for _, group := range podConfig.Groups {
+		if len(group.Namespaces) > 0 && !containsString(group.Namespaces, ingress.Namespace) {
+			continue
+		}
+		if len(group.Ingresses) > 0 && !containsString(group.Ingresses, ingress.Name) {
+			continue
+		}
+		return group.Termination
+	}
+	return podConfig.Termination
+}
+
+func deleteOptions(termination TerminationStrategy) (options metav1.DeleteOptions, err error) {
+	switch termination.Type {
+	case "", terminationForce:
+		return *metav1.NewDeleteOptions(0), nil
+	case terminationGraceful:
+		// Grace period of the pod itself
+		return metav1.DeleteOptions{}, nil
+	case terminationGracePeriod:
+		return *metav1.NewDeleteOptions(termination.GracePeriodSeconds), nil
+	}
+	return options, fmt.Errorf("unknown termination strategy %s", termination.Type)
+}
+
+// How long a signaled container has to exit, on top of the grace period of its pod
+const containerRestartTimeout = 30 * time.Second
+
+// validateTermination refuses strategies which can't work. The main process is PID 1 of the container,
+// and the kernel drops the signals sent to it from inside its own PID namespace unless it handles them,
+// so KILL and STOP never make it exit.
+func validateTermination(termination TerminationStrategy) (err error) {
+	if termination.Type != terminationContainer {
+		_, err = deleteOptions(termination)
+		return err
+	}
+	signal := strings.TrimPrefix(strings.ToUpper(termination.Signal), "SIG")
+	if signal == "KILL" || signal == "9" || signal == "STOP" || signal == "19" {
+		return fmt.Errorf("SIG%s can't be delivered to the main process of a container, use TERM, INT or another signal it handles", signal)
+	}
+	return nil
+}
+
+func validateTerminations(podConfig PodConfiguration) (err error) {
+	if err = validateTermination(podConfig.Termination); err != nil {
+		return err
+	}
+	for _, group := range podConfig.Groups {
+		if err = validateTermination(group.Termination); err != nil {
+			return fmt.Errorf("group %s: %v", group.Name, err)
+		}
+	}
+	return nil
+}
+
+func containerRestarts(pod *v1.Pod, container string) int32 {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == container {
+			return status.RestartCount
+		}
+	}
+	return 0
+}
+
+// killContainer signals the main process of a container, so the kubelet restarts it in place.
+// It fails unless the container actually restarts.
+func killContainer(ctx context.Context, clientset *kubernetes.Clientset, termination TerminationStrategy, pod v1.Pod) (err error) {
+	container := termination.Container
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+	}
+	signal := termination.Signal
+	if signal == "" {
+		signal = "TERM"
+	}
+	if err = validateTermination(TerminationStrategy{Type: terminationContainer, Signal: signal}); err != nil {
+		return err
+	}
+	restarts := containerRestarts(&pod, container)
+
+	log.Printf("Killing container %s of pod %s.%s with SIG%s\n", container, pod.Namespace, pod.Name, signal)
+	execErr := execInContainer(ctx, clientset, pod, container, []string{"/bin/sh", "-c", "kill -" + signal + " 1"})
+	if execErr != nil && strings.Contains(execErr.Error(), "executable file not found") {
+		return fmt.Errorf("container %s has no /bin/sh, the container strategy needs a shell and kill in the image: %v", container, execErr)
+	}
+
+	timeout := containerRestartTimeout
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		timeout += time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	}
+	// The exec session may fail because the container exits under it, so only a restart tells
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Second) {
+		current, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if containerRestarts(current, container) > restarts {
+			return nil
+		}
+	}
+	if execErr != nil {
+		return fmt.Errorf("container %s didn't restart: %v", container, execErr)
+	}
+	return fmt.Errorf("container %s didn't restart within %s, its main process doesn't exit on SIG%s", container, timeout, signal)
+}
+
+// execInContainer runs a command in a container, with kubectl exec semantics
+func execInContainer(ctx context.Context, clientset *kubernetes.Clientset, pod v1.Pod, container string, command []string) (err error) {
+	request := clientset.CoreV1().RESTClient().Post().Resource("pods").Namespace(pod.Namespace).Name(pod.Name).SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(restConfig, "POST", request.URL())
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: ioutil.Discard, Stderr: &stderr})
+	if err != nil {
+		return fmt.Errorf("%v %s", err, stderr.String())
+	}
+	return nil
+}
+
+// deletePod removes a victim using the termination strategy.
+// In safe mode the eviction API is used, so PodDisruptionBudgets are honoured.
+func deletePod(ctx context.Context, clientset *kubernetes.Clientset, podConfig PodConfiguration, termination TerminationStrategy, pod v1.Pod) (err error) {
+	if termination.Type == terminationContainer {
+		return killContainer(ctx, clientset, termination, pod)
+	}
+
+	options, err := deleteOptions(termination)
+	if err != nil {
+		return err
+	}
+
+	if podConfig.SafeMode {
+		log.Printf("Evicting pod %s.%s\n", pod.Namespace, pod.Name)
+		eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}, DeleteOptions: &options}
+		err = clientset.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+		if errors.IsTooManyRequests(err) {
+			return fmt.Errorf("eviction refused by a pod disruption budget: %v", err)
+		}
+		return err
+	}
+
+	if options.GracePeriodSeconds != nil && *options.GracePeriodSeconds == 0 {
+		log.Printf("Force deleting pod %s.%s\n", pod.Namespace, pod.Name)
+	} else {
+		log.Printf("Deleting pod %s.%s\n", pod.Namespace, pod.Name)
+	}
+	return clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, options)
+}
+
+const (
+	selectionOne      = "one"
+	selectionCount    = "count"
+	selectionPercent  = "percent"
+	selectionWorkload = "workload"
+	selectionPerZone  = "perZone"
+	selectionPerNode  = "perNode"
+)
+
+const zoneLabel = "topology.kubernetes.io/zone"
+
+// selectVictims picks the pods to disrupt out of the eligible candidates.
+// zones maps node names to their topology zone, it is only needed for the perZone selection.
+func selectVictims(selection PodSelection, candidates []v1.Pod, zones map[string]string) (victims []v1.Pod) {
+	if len(candidates) == 0 {
+		return victims
+	}
+	shuffled := make([]v1.Pod, len(candidates))
+	copy(shuffled, candidates)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+	count := 1
+	switch selection.Mode {
+	case "", selectionOne:
+	case selectionCount:
+		count = selection.Count
+	case selectionPercent:
+		count = int(math.Ceil(float64(len(shuffled)) * float64(selection.Percent) / 100))
+	case selectionWorkload:
+		group := podGroup(shuffled[0])
+		for _, pod := range shuffled {
+			if podGroup(pod) == group {
+				victims = append(victims, pod)
+			}
+		}
+		return victims
+	case selectionPerZone, selectionPerNode:
+		seen := map[string]bool{}
+		for _, pod := range shuffled {
+			key := pod.Spec.NodeName
+			if selection.Mode == selectionPerZone {
+				key = zones[pod.Spec.NodeName]
+			}
+			if !seen[key] {
+				seen[key] = true
+				victims = append(victims, pod)
+			}
+		}
+		return victims
+	default:
+		log.Printf("ERROR: Unknown pod selection mode %s.\n", selection.Mode)
+		return victims
+	}
+
+	if count < 1 {
+		count = 1
+	}
+	if count > len(shuffled) {
+		count = len(shuffled)
+	}
+	return shuffled[:count]
+}
+
+func nodeZones(ctx context.Context, clientset *kubernetes.Clientset) (zones map[string]string) {
+	zones = map[string]string{}
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of nodes to resolve zones: %v\n", err)
+		return zones
+	}
+	for _, node := range nodes.Items {
+		zones[node.Name] = node.Labels[zoneLabel]
+	}
+	return zones
+}
+
+// workloadPods keeps the pods belonging to a workload
+func workloadPods(ctx context.Context, clientset *kubernetes.Clientset, pods []v1.Pod, workload WorkloadReference) (result []v1.Pod) {
+	workloads := map[string]WorkloadReference{}
+	for _, pod := range pods {
+		group := podGroup(pod)
+		podWorkload, found := workloads[group]
+		if !found {
+			var err error
+			podWorkload, err = resolveWorkload(ctx, clientset, pod)
+			if err != nil {
+				log.Printf("ERROR: Cannot resolve the workload of %s.%s: %v\n", pod.Namespace, pod.Name, err)
+				continue
+			}
+			workloads[group] = podWorkload
+		}
+		if podWorkload == workload {
+			result = append(result, pod)
+		}
+	}
+	return result
+}
+
+type workloadBudget struct {
+	budget int
+	reason string
+}
+
+// podTarget is a randomly chosen endpoint with the pods behind it which are eligible for disruption
+type podTarget struct {
+	ingress    IngressState
+	endpoint   EndpointState
+	namespace  string
+	candidates []v1.Pod
+	// Every pod matching the selector of the endpoint, whichever workload it belongs to
+	selected []v1.Pod
+	// Number of pods which can still be disrupted per workload, unlimited when missing
+	budgets map[string]int
+}
+
+// choosePodTarget picks a random endpoint and applies the guardrails to the pods of its workload
+func choosePodTarget(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) (target podTarget, err error) {
+	podConfig := testPlan.Disruption.Pods
+	target.ingress = testPlan.Monitoring.Ingresses.Items[rand.Intn(len(testPlan.Monitoring.Ingresses.Items))]
+	target.endpoint = target.ingress.Endpoints[rand.Intn(len(target.ingress.Endpoints))]
+	// Older test plans have no endpoint namespace recorded
+	target.namespace = target.endpoint.Namespace
+	if target.namespace == "" {
+		target.namespace = target.ingress.Namespace
+	}
+	listOptions := labelSelectors(target.endpoint.PodSelector)
+	pods, err := clientset.CoreV1().Pods(target.namespace).List(ctx, listOptions)
+	if err != nil {
+		return target, err
+	}
+	target.selected = pods.Items
+	if target.endpoint.Workload.Name != "" {
+		pods.Items = workloadPods(ctx, clientset, pods.Items, target.endpoint.Workload)
+	}
+
+	unavailable := map[string]int{}
+	for _, pod := range pods.Items {
+		if !isPodAvailable(pod) {
+			unavailable[podGroup(pod)]++
+		}
+	}
+
+	target.budgets = map[string]int{}
+	workloads := map[string]workloadBudget{}
+	for _, pod := range pods.Items {
+		group := podGroup(pod)
+		allowed, overrides := checkGuardrails(ctx, clientset, testPlan.Safety, "pod", &pod)
+		if !allowed || !checkOverrides(overrides, "pod", pod.Namespace+"."+pod.Name, group, unavailable[group]) {
+			continue
+		}
+		budget := -1
+		if overrides.MaxDisruption >= 0 {
+			budget = overrides.MaxDisruption - unavailable[group]
+		}
+		if podConfig.SafeMode {
+			workload, found := workloads[group]
+			if !found {
+				workload.budget, workload.reason = checkWorkloadAvailability(ctx, clientset, pod, podConfig.MinAvailable)
+				workloads[group] = workload
+			}
+			if workload.reason != "" {
+				log.Printf("Safe mode: skipping pod %s.%s, %s.\n", pod.Namespace, pod.Name, workload.reason)
+				continue
+			}
+			if budget < 0 || workload.budget < budget {
+				budget = workload.budget
+			}
+		}
+		if existing, found := target.budgets[group]; budget >= 0 && (!found || budget < existing) {
+			target.budgets[group] = budget
+		}
+		target.candidates = append(target.candidates, pod)
+	}
+	return target, nil
+}
+
+func (target podTarget) disruptedPod(ctx context.Context, clientset *kubernetes.Clientset, pod v1.Pod) disruptedPod {
+	workload := target.endpoint.Workload
+	if workload.Name == "" {
+		workload, _ = resolveWorkload(ctx, clientset, pod)
+	}
+	return disruptedPod{Name: pod.Name, Labels: pod.Labels, Workload: workload, Node: pod.Spec.NodeName}
+}
+
+func killPodsOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	podConfig := testPlan.Disruption.Pods
+	target, err := choosePodTarget(ctx, testPlan, clientset)
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of running pods. Skipping for now. %v\n", err)
+		return
+	}
+	log.Printf("Deleting pods of %s on %s\n", target.endpoint.Workload, target.endpoint.URL)
+
+	zones := map[string]string{}
+	if podConfig.Selection.Mode == selectionPerZone {
+		zones = nodeZones(ctx, clientset)
+	}
+	victims := selectVictims(podConfig.Selection, target.candidates, zones)
+	if len(victims) == 0 {
+		fmt.Printf("No pods eligible for disruption for %v\n", target.endpoint.PodSelector)
+		return
+	}
+
+	mode := podConfig.Selection.Mode
+	if mode == "" {
+		mode = selectionOne
+	}
+	log.Printf("Selected %d of %d pods using the %s selection\n", len(victims), len(target.candidates), mode)
+	if target.endpoint.Workload.Name != "" {
+		log.Printf("Expected to affect %s\n", strings.Join(routesOfWorkload(testPlan, target.namespace, target.endpoint.Workload), ", "))
+	}
+	termination := terminationFor(podConfig, target.ingress)
+	disrupted := []disruptedPod{}
+	for _, victim := range victims {
+		// A pause may come while earlier victims are still terminating
+		if killSwitch.isPaused() {
+			log.Printf("Kill switch: paused, leaving the remaining pods of %s alone.\n", target.endpoint.URL)
+			break
+		}
+		group := podGroup(victim)
+		if budget, limited := target.budgets[group]; limited {
+			if budget <= 0 {
+				log.Printf("Guardrail: refusing to disrupt pod %s.%s, no disruptions left for %s.\n", victim.Namespace, victim.Name, group)
+				continue
 			}
+			target.budgets[group] = budget - 1
+		}
+		err := deletePod(ctx, clientset, podConfig, termination, victim)
+		if err != nil {
+			log.Printf("ERROR: Cannot delete a pod %s.%s: %v\n", victim.Namespace, victim.Name, err)
+		} else {
+			recordDisruption(group)
+			disrupted = append(disrupted, target.disruptedPod(ctx, clientset, victim))
 		}
+	}
+	if len(disrupted) > 0 {
+		reportDisruption(testPlan, disruptionEvent{Action: "pod deletion", Namespace: target.namespace, Pods: disrupted})
+	}
+}
+
+func killPods(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("pods", func() { killPodsOnce(ctx, testPlan, clientset) })
+
+	for true {
+		waitForSchedule(testPlan, "pod killer")
+		disruptors.run("pods")
 
 		duration := time.Duration(rand.Int63n(testPlan.Disruption.Pods.Interval.Nanoseconds())) * time.Nanosecond
 		log.Printf("For next pod deletion sleeping for %s\n", duration)
 		//log.Printf("Interval: %s, random %s\n", testPlan.Ingresses.Interval, duration)
-		time.Sleep(duration)
+		disruptors.sleep("pods", duration)
 	}
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type StressConfiguration struct {
+	Enabled   bool          `yaml:"enabled"`
+	Interval  time.Duration `yaml:"interval"`
+	Duration  time.Duration `yaml:"duration"`
+	Namespace string        `yaml:"namespace"`
+	Image     string        `yaml:"image"`
+	CPU       int           `yaml:"cpu"`
+	Memory    string        `yaml:"memory"`
+	Disk      string        `yaml:"disk"`
+}
+
+func withStressDefaults(stressConfig StressConfiguration) StressConfiguration {
+	if stressConfig.Duration <= 0 {
+		stressConfig.Duration = 2 * time.Minute
+	}
+	if stressConfig.Namespace == "" {
+		stressConfig.Namespace = "default"
+	}
+	if stressConfig.Image == "" {
+		// The stress mode has to match the flags passed by this build
+		stressConfig.Image = "alexlokshin/kube-entropy:" + version
+	}
+	return stressConfig
+}
+
+// Headroom above the stressed memory and disk for the process itself, so the limits never stop the stress early
+var stressHeadroom = resource.MustParse("64Mi")
+
+// Token requests of the stress pod. Requests reserve capacity, so requesting the load would leave the node without pressure.
+// They are set anyway, as Kubernetes defaults missing requests to the limits.
+var stressRequests = v1.ResourceList{
+	v1.ResourceCPU:              resource.MustParse("10m"),
+	v1.ResourceMemory:           resource.MustParse("16Mi"),
+	v1.ResourceEphemeralStorage: resource.MustParse("1Mi"),
+}
+
+// stressPod runs the stress mode of the kube-entropy image on a node, bypassing the scheduler
+func stressPod(stressConfig StressConfiguration, node string) (pod *v1.Pod, err error) {
+	args := []string{"-mode", "stress", "-stress-duration", stressConfig.Duration.String(), "-stress-dir", "/stress"}
+	resources := []string{}
+	// Limits bound the load, while the requests stay small
+	requests, limits := v1.ResourceList{}, v1.ResourceList{}
+	if stressConfig.CPU > 0 {
+		args = append(args, "-stress-cpu", strconv.Itoa(stressConfig.CPU))
+		resources = append(resources, "cpu")
+		requests[v1.ResourceCPU] = stressRequests[v1.ResourceCPU]
+		limits[v1.ResourceCPU] = *resource.NewQuantity(int64(stressConfig.CPU), resource.DecimalSI)
+	}
+	for _, quantity := range []struct {
+		flag, value string
+		name        v1.ResourceName
+	}{{"-stress-memory", stressConfig.Memory, v1.ResourceMemory}, {"-stress-disk", stressConfig.Disk, v1.ResourceEphemeralStorage}} {
+		if quantity.value == "" {
+			continue
+		}
+		parsed, err := resource.ParseQuantity(quantity.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity %s: %v", quantity.value, err)
+		}
+		args = append(args, quantity.flag, quantity.value)
+		resources = append(resources, strings.TrimPrefix(quantity.flag, "-stress-"))
+		parsed.Add(stressHeadroom)
+		requests[quantity.name] = stressRequests[quantity.name]
+		limits[quantity.name] = parsed
+	}
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("no cpu, memory or disk to stress")
+	}
+
+	// The deadline makes the kubelet stop the pod even if kube-entropy never gets to delete it
+	deadline := int64(stressConfig.Duration.Seconds()) + 60
+	pod = &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("kube-entropy-stress-%d", rand.Int31()),
+			Namespace:   stressConfig.Namespace,
+			Labels:      map[string]string{managedLabel: "true"},
+			Annotations: map[string]string{"kube-entropy.io/stress": strings.Join(resources, ",")},
+		},
+		Spec: v1.PodSpec{
+			NodeName:              node,
+			RestartPolicy:         v1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &deadline,
+			Containers: []v1.Container{{
+				Name:         "stress",
+				Image:        stressConfig.Image,
+				Args:         args,
+				Resources:    v1.ResourceRequirements{Requests: requests, Limits: limits},
+				VolumeMounts: []v1.VolumeMount{{Name: "stress", MountPath: "/stress"}},
+			}},
+			Volumes: []v1.Volume{{Name: "stress", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}},
+		},
+	}
+	return pod, nil
+}
+
+func stressNodeOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	stressConfig := withStressDefaults(testPlan.Disruption.Stress)
+	nodes, err := listTargetNodes(ctx, clientset, testPlan.Disruption.Nodes)
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of nodes. Skipping for now: %v\n", err)
+		return
+	}
+	candidates := []v1.Node{}
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || nodeProblem(node) != "" {
+			continue
+		}
+		if allowed, _ := checkGuardrails(ctx, clientset, testPlan.Safety, "node", &node); allowed {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		log.Println("No nodes eligible for a stress pod.")
+		return
+	}
+	node := candidates[rand.Intn(len(candidates))]
+
+	pod, err := stressPod(stressConfig, node.Name)
+	if err != nil {
+		log.Printf("ERROR: Cannot create a stress pod: %v\n", err)
+		return
+	}
+	if allowed, _ := checkGuardrails(ctx, clientset, testPlan.Safety, "pod", pod); !allowed {
+		return
+	}
+
+	entry := undoEntry{Kind: undoPod, Namespace: pod.Namespace, Name: pod.Name}
+	id := journal.record(entry.Kind, entry.Namespace, entry.Name, entry.Data)
+	defer restoreJournaled(ctx, clientset, id, entry)
+
+	log.Printf("Stressing %s of %s with pod %s.%s for %s\n", pod.Annotations["kube-entropy.io/stress"], node.Name, pod.Namespace, pod.Name, stressConfig.Duration)
+	routes := routesOnNode(testPlan, livePlacement(ctx, clientset, testPlan), node.Name)
+	if len(routes) > 0 {
+		log.Printf("Expected to affect %s\n", strings.Join(routes, ", "))
+	}
+	_, err = clientset.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot create stress pod %s.%s: %v\n", pod.Namespace, pod.Name, err)
+		return
+	}
+	recordDisruption("node/" + node.Name)
+	reportDisruption(testPlan, disruptionEvent{Action: "stress " + pod.Annotations["kube-entropy.io/stress"], Nodes: []string{node.Name}, Endpoints: routes, Objects: []string{pod.Namespace + "." + pod.Name}})
+	sleepUnlessPaused(stressConfig.Duration)
+}
+
+func stressNodes(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("stress", func() { stressNodeOnce(ctx, testPlan, clientset) })
+
+	for true {
+		waitForSchedule(testPlan, "node stressor")
+		disruptors.run("stress")
+
+		duration := time.Duration(rand.Int63n(testPlan.Disruption.Stress.Interval.Nanoseconds())) * time.Nanosecond
+		log.Printf("For next stress pod sleeping for %s\n", duration)
+		disruptors.sleep("stress", duration)
+	}
+}
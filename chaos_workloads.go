@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	workloadScale   = "scale"
+	workloadRestart = "restart"
+	workloadAny     = "any"
+)
+
+// Pod template annotation changed by kubectl rollout restart
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+type WorkloadConfiguration struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	Duration time.Duration `yaml:"duration"`
+	Mode     string        `yaml:"mode"`
+	Fraction float64       `yaml:"fraction"`
+}
+
+func withWorkloadDefaults(workloadConfig WorkloadConfiguration) WorkloadConfiguration {
+	if workloadConfig.Mode == "" {
+		workloadConfig.Mode = workloadScale
+	}
+	if workloadConfig.Fraction <= 0 || workloadConfig.Fraction >= 1 {
+		workloadConfig.Fraction = 0.5
+	}
+	if workloadConfig.Duration <= 0 {
+		workloadConfig.Duration = time.Minute
+	}
+	return workloadConfig
+}
+
+// scaledReplicas is the replica count left after scaling down to a fraction, at least one replica is removed
+// and at least one is kept, so a single replica workload is never scaled down
+func scaledReplicas(replicas int, fraction float64) int {
+	scaled := int(math.Floor(float64(replicas) * fraction))
+	if scaled >= replicas {
+		scaled = replicas - 1
+	}
+	if scaled < 1 && replicas > 0 {
+		return 1
+	}
+	if scaled < 0 {
+		return 0
+	}
+	return scaled
+}
+
+// scalableWorkloads lists the deployments and stateful sets serving the endpoints of the test plan
+func scalableWorkloads(testPlan ApplicationState) (namespaces []string, workloads []WorkloadReference) {
+	seen := map[string]bool{}
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		for _, endpoint := range ingress.Endpoints {
+			if endpoint.Workload.Kind != "Deployment" && endpoint.Workload.Kind != "StatefulSet" {
+				continue
+			}
+			namespace := endpoint.Namespace
+			if namespace == "" {
+				namespace = ingress.Namespace
+			}
+			key := namespace + "/" + endpoint.Workload.String()
+			if !seen[key] {
+				seen[key] = true
+				namespaces = append(namespaces, namespace)
+				workloads = append(workloads, endpoint.Workload)
+			}
+		}
+	}
+	return namespaces, workloads
+}
+
+type scalableWorkload struct {
+	object              metav1.Object
+	replicas            int
+	readyReplicas       int
+	templateAnnotations map[string]string
+}
+
+func getScalableWorkload(ctx context.Context, clientset *kubernetes.Clientset, namespace string, workload WorkloadReference) (scalable scalableWorkload, err error) {
+	switch workload.Kind {
+	case "Deployment":
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return scalable, err
+		}
+		scalable = scalableWorkload{object: deployment, replicas: 1, readyReplicas: int(deployment.Status.ReadyReplicas), templateAnnotations: deployment.Spec.Template.Annotations}
+		if deployment.Spec.Replicas != nil {
+			scalable.replicas = int(*deployment.Spec.Replicas)
+		}
+	case "StatefulSet":
+		statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return scalable, err
+		}
+		scalable = scalableWorkload{object: statefulSet, replicas: 1, readyReplicas: int(statefulSet.Status.ReadyReplicas), templateAnnotations: statefulSet.Spec.Template.Annotations}
+		if statefulSet.Spec.Replicas != nil {
+			scalable.replicas = int(*statefulSet.Spec.Replicas)
+		}
+	default:
+		return scalable, fmt.Errorf("cannot disrupt a %s", workload.Kind)
+	}
+	return scalable, nil
+}
+
+func patchWorkload(ctx context.Context, clientset *kubernetes.Clientset, namespace string, kind string, name string, patch interface{}) (err error) {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "Deployment":
+		_, err = clientset.AppsV1().Deployments(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = clientset.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("cannot patch a %s", kind)
+	}
+	return err
+}
+
+func scaleWorkload(ctx context.Context, clientset *kubernetes.Clientset, namespace string, kind string, name string, replicas int) (err error) {
+	return patchWorkload(ctx, clientset, namespace, kind, name, map[string]interface{}{"spec": map[string]interface{}{"replicas": replicas}})
+}
+
+// patchTemplateAnnotation sets an annotation of the pod template, or removes it when the value is nil
+func patchTemplateAnnotation(ctx context.Context, clientset *kubernetes.Clientset, namespace string, kind string, name string, key string, value *string) (err error) {
+	patch := map[string]interface{}{"spec": map[string]interface{}{"template": map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]interface{}{key: value}}}}}
+	return patchWorkload(ctx, clientset, namespace, kind, name, patch)
+}
+
+func scaleDownWorkload(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset, workloadConfig WorkloadConfiguration, namespace string, workload WorkloadReference, scalable scalableWorkload) {
+	scaled := scaledReplicas(scalable.replicas, workloadConfig.Fraction)
+	if scaled >= scalable.replicas {
+		log.Printf("%s.%s has no replicas to scale down.\n", namespace, workload)
+		return
+	}
+
+	entry := undoEntry{Kind: undoScale, Namespace: namespace, Name: workload.Name, Data: map[string]string{"kind": workload.Kind, "replicas": strconv.Itoa(scalable.replicas)}}
+	id := journal.record(entry.Kind, entry.Namespace, entry.Name, entry.Data)
+	defer restoreJournaled(ctx, clientset, id, entry)
+
+	log.Printf("Scaling %s.%s from %d down to %d replicas for %s\n", namespace, workload, scalable.replicas, scaled, workloadConfig.Duration)
+	err := scaleWorkload(ctx, clientset, namespace, workload.Kind, workload.Name, scaled)
+	if err != nil {
+		log.Printf("ERROR: Cannot scale %s.%s: %v\n", namespace, workload, err)
+		return
+	}
+	reportDisruption(testPlan, disruptionEvent{Action: "scale down", Namespace: namespace, Workloads: []WorkloadReference{workload}})
+	sleepUnlessPaused(workloadConfig.Duration)
+}
+
+// restartWorkload triggers a rollout like kubectl rollout restart. The original annotation is restored
+// after the duration, which rolls the workload once more but leaves its spec as it was.
+func restartWorkload(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset, workloadConfig WorkloadConfiguration, namespace string, workload WorkloadReference, scalable scalableWorkload) {
+	data := map[string]string{"kind": workload.Kind, "annotation": restartedAtAnnotation}
+	if original, found := scalable.templateAnnotations[restartedAtAnnotation]; found {
+		data["value"] = original
+	}
+	entry := undoEntry{Kind: undoTemplateAnnotation, Namespace: namespace, Name: workload.Name, Data: data}
+	id := journal.record(entry.Kind, entry.Namespace, entry.Name, entry.Data)
+	defer restoreJournaled(ctx, clientset, id, entry)
+
+	log.Printf("Restarting %s.%s\n", namespace, workload)
+	restartedAt := time.Now().Format(time.RFC3339)
+	err := patchTemplateAnnotation(ctx, clientset, namespace, workload.Kind, workload.Name, restartedAtAnnotation, &restartedAt)
+	if err != nil {
+		log.Printf("ERROR: Cannot restart %s.%s: %v\n", namespace, workload, err)
+		return
+	}
+	reportDisruption(testPlan, disruptionEvent{Action: "rollout restart", Namespace: namespace, Workloads: []WorkloadReference{workload}})
+	sleepUnlessPaused(workloadConfig.Duration)
+}
+
+func disruptWorkloadOnce(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	workloadConfig := withWorkloadDefaults(testPlan.Disruption.Workloads)
+	namespaces, workloads := scalableWorkloads(testPlan)
+	if len(workloads) == 0 {
+		log.Printf("No deployments or stateful sets recorded in the test plan.\n")
+		return
+	}
+	i := rand.Intn(len(workloads))
+	namespace, workload := namespaces[i], workloads[i]
+
+	scalable, err := getScalableWorkload(ctx, clientset, namespace, workload)
+	if err != nil {
+		log.Printf("ERROR: Cannot get %s.%s: %v\n", namespace, workload, err)
+		return
+	}
+	group := namespace + "/" + workload.String()
+	allowed, overrides := checkGuardrails(ctx, clientset, testPlan.Safety, workload.Kind, scalable.object)
+	if !allowed || !checkOverrides(overrides, workload.Kind, namespace+"."+workload.Name, group, scalable.replicas-scalable.readyReplicas) {
+		return
+	}
+
+	mode := workloadConfig.Mode
+	if mode == workloadAny {
+		mode = []string{workloadScale, workloadRestart}[rand.Intn(2)]
+	}
+	recordDisruption(group)
+	switch mode {
+	case workloadScale:
+		scaleDownWorkload(ctx, testPlan, clientset, workloadConfig, namespace, workload, scalable)
+	case workloadRestart:
+		restartWorkload(ctx, testPlan, clientset, workloadConfig, namespace, workload, scalable)
+	default:
+		log.Printf("ERROR: Unknown workload disruption mode %s.\n", mode)
+	}
+}
+
+func disruptWorkloads(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	disruptors.register("workloads", func() { disruptWorkloadOnce(ctx, testPlan, clientset) })
+
+	for true {
+		waitForSchedule(testPlan, "workload disruptor")
+		disruptors.run("workloads")
+
+		duration := time.Duration(rand.Int63n(testPlan.Disruption.Workloads.Interval.Nanoseconds())) * time.Nanosecond
+		log.Printf("For next workload disruption sleeping for %s\n", duration)
+		disruptors.sleep("workloads", duration)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Environment variable with the static bearer token of the control API, when no token file is set
+const apiTokenVariable = "KUBE_ENTROPY_API_TOKEN"
+
+const apiPrefix = "/api/v1/"
+
+// Access levels of the control API endpoints
+const (
+	// GET without authentication, for the dashboard and monitoring
+	apiPublic = iota
+	// GET for authenticated users only, e.g. the test plan with its targets
+	apiPrivate
+	// POST for authenticated users only
+	apiMutation
+)
+
+type ControlAPIConfiguration struct {
+	Enabled      bool     `yaml:"enabled"`
+	TokenFile    string   `yaml:"tokenFile"`
+	TokenReview  bool     `yaml:"tokenReview"`
+	Audiences    []string `yaml:"audiences"`
+	AllowedUsers []string `yaml:"allowedUsers"`
+}
+
+// stopRun asks the chaos mode to stop, restore and report, like a termination signal
+var stopRun = make(chan bool, 1)
+
+type controlAPI struct {
+	ctx       context.Context
+	testPlan  ApplicationState
+	clientset *kubernetes.Clientset
+	config    ControlAPIConfiguration
+	token     string
+}
+
+type apiStatus struct {
+	Paused      bool              `json:"paused"`
+	PausedBy    []string          `json:"pausedBy"`
+	PendingUndo int               `json:"pendingUndo"`
+	Disruptors  []disruptorStatus `json:"disruptors"`
+}
+
+func newControlAPI(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) (api *controlAPI, err error) {
+	api = &controlAPI{ctx: ctx, testPlan: testPlan, clientset: clientset, config: testPlan.API, token: os.Getenv(apiTokenVariable)}
+	if api.config.TokenFile != "" {
+		data, err := ioutil.ReadFile(api.config.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the control API token: %v", err)
+		}
+		api.token = strings.TrimSpace(string(data))
+	}
+	// Every workload of the cluster has a service account token which passes a TokenReview
+	if api.config.TokenReview && len(api.config.AllowedUsers) == 0 {
+		return nil, fmt.Errorf("control API token reviews need allowedUsers, otherwise any service account could disrupt the cluster")
+	}
+	if api.token == "" && !api.config.TokenReview {
+		log.Printf("Control API has neither a token nor token reviews, mutations and the plan and status are disabled.\n")
+	}
+	return api, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Printf("ERROR: Cannot write a control API response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// authenticate checks the bearer token of a request, either against the static token or with a TokenReview
+func (api *controlAPI) authenticate(r *http.Request) (user string, err error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", fmt.Errorf("bearer token required")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if api.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) == 1 {
+		return "token", nil
+	}
+	if !api.config.TokenReview || api.clientset == nil {
+		return "", fmt.Errorf("invalid token")
+	}
+
+	review := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: api.config.Audiences}}
+	review, err = api.clientset.AuthenticationV1().TokenReviews().Create(r.Context(), review, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot review a control API token: %v\n", err)
+		return "", fmt.Errorf("cannot review the token")
+	}
+	if !review.Status.Authenticated {
+		return "", fmt.Errorf("invalid token")
+	}
+	user = review.Status.User.Username
+	if !containsString(api.config.AllowedUsers, user) {
+		return "", fmt.Errorf("user %s is not allowed", user)
+	}
+	return user, nil
+}
+
+// handle serves a read endpoint on GET, or a mutation endpoint on POST, authenticating the users unless it is public
+func (api *controlAPI) handle(mux *http.ServeMux, path string, access int, handler func(w http.ResponseWriter, r *http.Request, user string)) {
+	mux.HandleFunc(apiPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+		method := http.MethodGet
+		if access == apiMutation {
+			method = http.MethodPost
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s only", method))
+			return
+		}
+		user := ""
+		if access != apiPublic {
+			var err error
+			user, err = api.authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, err)
+				return
+			}
+		}
+		handler(w, r, user)
+	})
+}
+
+func (api *controlAPI) status() apiStatus {
+	return apiStatus{Paused: killSwitch.isPaused(), PausedBy: killSwitch.activeSources(), PendingUndo: len(journal.pending()), Disruptors: disruptors.list()}
+}
+
+func (api *controlAPI) routes(mux *http.ServeMux) {
+	api.handle(mux, "plan", apiPrivate, func(w http.ResponseWriter, r *http.Request, user string) {
+		writeJSON(w, http.StatusOK, api.testPlan)
+	})
+	api.handle(mux, "status", apiPrivate, func(w http.ResponseWriter, r *http.Request, user string) {
+		writeJSON(w, http.StatusOK, api.status())
+	})
+	api.handle(mux, "disruptors", apiPublic, func(w http.ResponseWriter, r *http.Request, user string) {
+		writeJSON(w, http.StatusOK, disruptors.list())
+	})
+	api.handle(mux, "probes", apiPublic, func(w http.ResponseWriter, r *http.Request, user string) {
+		writeJSON(w, http.StatusOK, timeline.probeResults())
+	})
+	api.dashboardRoutes(mux)
+
+	// Triggered actions skip the schedule, but not the kill switch and guardrails
+	api.handle(mux, "disruptors/", apiMutation, func(w http.ResponseWriter, r *http.Request, user string) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiPrefix+"disruptors/"), "/trigger")
+		if !strings.HasSuffix(r.URL.Path, "/trigger") || name == "" || strings.Contains(name, "/") {
+			writeError(w, http.StatusNotFound, fmt.Errorf("use %sdisruptors/<name>/trigger", apiPrefix))
+			return
+		}
+		if killSwitch.isPaused() {
+			writeError(w, http.StatusConflict, fmt.Errorf("disruptions are paused"))
+			return
+		}
+		if _, err := disruptors.get(name); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if err := disruptors.trigger(name); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		log.Printf("Control API: %s triggered the %s disruptor.\n", user, name)
+		writeJSON(w, http.StatusAccepted, api.status())
+	})
+	api.handle(mux, "pause", apiMutation, func(w http.ResponseWriter, r *http.Request, user string) {
+		if killSwitch.set(pauseSourceAPI, true) {
+			log.Printf("Control API: paused by %s, stopping all disruptions and restoring.\n", user)
+			metrics.addCounter("kube_entropy_pauses_total", "Number of times the disruptions were paused.", nil, 1)
+		}
+		if api.clientset != nil {
+			undoAll(api.ctx, api.clientset)
+		}
+		writeJSON(w, http.StatusOK, api.status())
+	})
+	api.handle(mux, "resume", apiMutation, func(w http.ResponseWriter, r *http.Request, user string) {
+		if killSwitch.set(pauseSourceAPI, false) {
+			log.Printf("Control API: resumed by %s.\n", user)
+		}
+		writeJSON(w, http.StatusOK, api.status())
+	})
+	api.handle(mux, "stop", apiMutation, func(w http.ResponseWriter, r *http.Request, user string) {
+		log.Printf("Control API: stopped by %s.\n", user)
+		select {
+		case stopRun <- true:
+		default:
+		}
+		writeJSON(w, http.StatusAccepted, api.status())
+	})
+}
+
+// startControlAPI adds the control API to the handlers served along with the metrics
+func startControlAPI(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset) {
+	api, err := newControlAPI(ctx, testPlan, clientset)
+	if err != nil {
+		betterPanic(err.Error())
+	}
+	api.routes(http.DefaultServeMux)
+}
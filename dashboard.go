@@ -0,0 +1,94 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"time"
+)
+
+// Most recent disruptions shown on the dashboard
+const maxDashboardDisruptions = 50
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+type dashboardEndpoint struct {
+	probeResult
+	Down      bool          `json:"down"`
+	DownSince time.Time     `json:"downSince"`
+	History   []probeBucket `json:"history"`
+}
+
+type dashboardDisruption struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Targets string    `json:"targets"`
+	Global  bool      `json:"global"`
+	Outages int       `json:"outages"`
+}
+
+type dashboardState struct {
+	Time        time.Time             `json:"time"`
+	SteadyState steadyStateVerdict    `json:"steadyState"`
+	Status      apiStatus             `json:"status"`
+	Endpoints   []dashboardEndpoint   `json:"endpoints"`
+	Disruptions []dashboardDisruption `json:"disruptions"`
+}
+
+// dashboardEndpoint returns the latest probe, the open outage and the probe history of an endpoint
+func (t *eventTimeline) dashboardEndpoint(ingress IngressState, endpoint EndpointState) (state dashboardEndpoint) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	state = dashboardEndpoint{probeResult: probeResult{Ingress: ingress.Namespace + "." + ingress.Name, URL: endpoint.URL}, History: []probeBucket{}}
+	if result, found := t.latest[endpoint.URL]; found {
+		state.probeResult = *result
+	}
+	if current, down := t.open[endpoint.URL]; down {
+		state.Down, state.DownSince = true, current.Start
+	}
+	state.History = append(state.History, t.history[endpoint.URL]...)
+	return state
+}
+
+// recentDisruptions returns the latest disruptions, newest first, with the number of outages attributed to them
+func (t *eventTimeline) recentDisruptions(limit int) (disruptions []dashboardDisruption) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	disruptions = []dashboardDisruption{}
+	for i := len(t.disruptions) - 1; i >= 0 && len(disruptions) < limit; i-- {
+		disruption := t.disruptions[i]
+		outages := 0
+		for _, o := range t.outages {
+			if o.DisruptionID == disruption.ID {
+				outages++
+			}
+		}
+		disruptions = append(disruptions, dashboardDisruption{ID: disruption.ID, Time: disruption.Time, Action: disruption.Action,
+			Targets: disruption.targets(), Global: disruption.Global, Outages: outages})
+	}
+	return disruptions
+}
+
+func (api *controlAPI) dashboard() (state dashboardState) {
+	state = dashboardState{Time: time.Now(), Status: api.status(), Endpoints: []dashboardEndpoint{}}
+	state.SteadyState = timeline.steadyState(api.testPlan.Monitoring.SteadyState, state.Time)
+	for _, ingress := range api.testPlan.Monitoring.Ingresses.Items {
+		for _, endpoint := range ingress.Endpoints {
+			state.Endpoints = append(state.Endpoints, timeline.dashboardEndpoint(ingress, endpoint))
+		}
+	}
+	state.Disruptions = timeline.recentDisruptions(maxDashboardDisruptions)
+	return state
+}
+
+// dashboardRoutes serves the dashboard page, which polls its state from the control API
+func (api *controlAPI) dashboardRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	api.handle(mux, "dashboard", apiPublic, func(w http.ResponseWriter, r *http.Request, user string) {
+		writeJSON(w, http.StatusOK, api.dashboard())
+	})
+}
@@ -16,12 +16,24 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
+type WorkloadReference struct {
+	Kind string `yaml:"kind"`
+	Name string `yaml:"name"`
+}
+
+func (workload WorkloadReference) String() string {
+	return workload.Kind + "/" + workload.Name
+}
+
 type EndpointState struct {
 	URL         string            `yaml:"url"`
 	Method      string            `yaml:"method"`
 	Headers     map[string]string `yaml:"headers"`
 	Code        int               `yaml:"code"`
 	PodSelector map[string]string
+	Namespace   string            `yaml:"namespace"`
+	Workload    WorkloadReference `yaml:"workload"`
+	Topology    EndpointTopology  `yaml:"topology"`
 }
 
 type IngressState struct {
@@ -30,15 +42,56 @@ type IngressState struct {
 	Endpoints []EndpointState `yaml:"endpoints"`
 }
 
+type NodeTaint struct {
+	Key    string `yaml:"key"`
+	Value  string `yaml:"value"`
+	Effect string `yaml:"effect"`
+}
+
 type NodeConfiguration struct {
-	Enabled  bool          `yaml:"enabled"`
-	Interval time.Duration `yaml:"interval"`
-	Items    []string      `yaml:"items"`
+	Enabled        bool          `yaml:"enabled"`
+	Interval       time.Duration `yaml:"interval"`
+	Mode           string        `yaml:"mode"`
+	Duration       time.Duration `yaml:"duration"`
+	Taint          NodeTaint     `yaml:"taint"`
+	Fields         []string      `yaml:"fields"`
+	Labels         []string      `yaml:"labels"`
+	Selection      string        `yaml:"selection"`
+	MaxPerZone     int           `yaml:"maxPerZone"`
+	CapacityGuard  bool          `yaml:"capacityGuard"`
+	MinReadyNodes  int           `yaml:"minReadyNodes"`
+	MaxPendingPods int           `yaml:"maxPendingPods"`
+	Items          []string      `yaml:"items"`
+}
+
+type TerminationStrategy struct {
+	Type               string `yaml:"type"`
+	GracePeriodSeconds int64  `yaml:"gracePeriodSeconds"`
+	Container          string `yaml:"container"`
+	Signal             string `yaml:"signal"`
+}
+
+type PodTargetGroup struct {
+	Name        string              `yaml:"name"`
+	Namespaces  []string            `yaml:"namespaces"`
+	Ingresses   []string            `yaml:"ingresses"`
+	Termination TerminationStrategy `yaml:"termination"`
+}
+
+type PodSelection struct {
+	Mode    string `yaml:"mode"`
+	Count   int    `yaml:"count"`
+	Percent int    `yaml:"percent"`
 }
 
 type PodConfiguration struct {
-	Enabled  bool          `yaml:"enabled"`
-	Interval time.Duration `yaml:"interval"`
+	Enabled      bool                `yaml:"enabled"`
+	Interval     time.Duration       `yaml:"interval"`
+	SafeMode     bool                `yaml:"safeMode"`
+	MinAvailable string              `yaml:"minAvailable"`
+	Termination  TerminationStrategy `yaml:"termination"`
+	Selection    PodSelection        `yaml:"selection"`
+	Groups       []PodTargetGroup    `yaml:"groups"`
 }
 
 type IngressConfiguration struct {
@@ -47,17 +100,31 @@ type IngressConfiguration struct {
 }
 
 type MonitoringConfiguration struct {
-	Enabled   bool                 `yaml:"enabled"`
-	Interval  time.Duration        `yaml:"interval"`
-	Ingresses IngressConfiguration `yaml:"ingresses"`
+	Enabled     bool                     `yaml:"enabled"`
+	Interval    time.Duration            `yaml:"interval"`
+	Ingresses   IngressConfiguration     `yaml:"ingresses"`
+	Recovery    RecoveryConfiguration    `yaml:"recovery"`
+	Load        LoadConfiguration        `yaml:"load"`
+	SteadyState SteadyStateConfiguration `yaml:"steadyState"`
 }
 
 type DisruptionConfiguration struct {
-	Nodes NodeConfiguration `yaml:"nodes"`
-	Pods  PodConfiguration  `yaml:"pods"`
+	Nodes             NodeConfiguration              `yaml:"nodes"`
+	Pods              PodConfiguration               `yaml:"pods"`
+	Workloads         WorkloadConfiguration          `yaml:"workloads"`
+	Network           NetworkConfiguration           `yaml:"network"`
+	DNS               DNSConfiguration               `yaml:"dns"`
+	Stress            StressConfiguration            `yaml:"stress"`
+	IngressController IngressControllerConfiguration `yaml:"ingressController"`
+	Proxies           []ProxyConfiguration           `yaml:"proxies"`
 }
 
 type ApplicationState struct {
+	Safety     SafetyConfiguration     `yaml:"safety"`
+	Schedule   ScheduleConfiguration   `yaml:"schedule"`
+	KillSwitch KillSwitchConfiguration `yaml:"killSwitch"`
+	API        ControlAPIConfiguration `yaml:"api"`
+	Webhooks   []WebhookConfiguration  `yaml:"webhooks"`
 	Disruption DisruptionConfiguration `yaml:"disruption"`
 	Monitoring MonitoringConfiguration `yaml:"monitoring"`
 }
@@ -65,7 +132,7 @@ type ApplicationState struct {
 func discover(ctx context.Context, dc discoveryConfig, clientset *kubernetes.Clientset) {
 
 	fmt.Printf("Creating a test plan.\n")
-	listOptions := listSelectors(dc.Nodes)
+	listOptions := listSelectors(dc.Nodes.entropySelector)
 	nodes, err := clientset.CoreV1().Nodes().List(ctx, listOptions)
 	if err != nil {
 		betterPanic(err.Error())
@@ -77,24 +144,57 @@ func discover(ctx context.Context, dc discoveryConfig, clientset *kubernetes.Cli
 	}
 
 	appState := ApplicationState{
+		Safety:     dc.Safety,
+		Schedule:   dc.Schedule,
+		KillSwitch: dc.KillSwitch,
+		API:        dc.API,
+		Webhooks:   dc.Webhooks,
 		Disruption: DisruptionConfiguration{
 			Nodes: NodeConfiguration{
-				Enabled:  dc.Nodes.Enabled,
-				Interval: dc.Nodes.Interval},
+				Enabled:        dc.Nodes.Enabled,
+				Interval:       dc.Nodes.Interval,
+				Mode:           dc.Nodes.Mode,
+				Duration:       dc.Nodes.Duration,
+				Taint:          dc.Nodes.Taint,
+				Fields:         dc.Nodes.Fields,
+				Labels:         dc.Nodes.Labels,
+				Selection:      dc.Nodes.Selection,
+				MaxPerZone:     dc.Nodes.MaxPerZone,
+				CapacityGuard:  dc.Nodes.CapacityGuard,
+				MinReadyNodes:  dc.Nodes.MinReadyNodes,
+				MaxPendingPods: dc.Nodes.MaxPendingPods},
 			Pods: PodConfiguration{
-				Enabled:  dc.Pods.Enabled,
-				Interval: dc.Pods.Interval,
+				Enabled:      dc.Pods.Enabled,
+				Interval:     dc.Pods.Interval,
+				SafeMode:     dc.Pods.SafeMode,
+				MinAvailable: dc.Pods.MinAvailable,
+				Termination:  dc.Pods.Termination,
+				Selection:    dc.Pods.Selection,
+				Groups:       dc.Pods.Groups,
 			},
+			Workloads:         dc.Workloads,
+			Network:           dc.Network,
+			DNS:               dc.DNS,
+			Stress:            dc.Stress,
+			IngressController: dc.IngressController,
+			Proxies:           dc.Proxies,
 		},
 		Monitoring: MonitoringConfiguration{
-			Enabled:  dc.Ingress.Selector.Enabled,
-			Interval: dc.Ingress.Selector.Interval,
+			Enabled:     dc.Ingress.Selector.Enabled,
+			Interval:    dc.Ingress.Selector.Interval,
+			Recovery:    dc.Ingress.Recovery,
+			Load:        dc.Ingress.Load,
+			SteadyState: dc.Ingress.SteadyState,
 			Ingresses: IngressConfiguration{
 
 				SuccessHTTPCodes: dc.Ingress.SuccessHTTPCodes},
 		},
 	}
 
+	if appState.Disruption.Pods.Selection.Mode == "" {
+		appState.Disruption.Pods.Selection.Mode = selectionOne
+	}
+
 	fmt.Printf("\nnodes:\n")
 	for _, node := range nodes.Items {
 		fmt.Printf("%s\n", node.Name)
@@ -150,7 +250,10 @@ func discover(ctx context.Context, dc discoveryConfig, clientset *kubernetes.Cli
 					if statusCode == 503 || statusCode == 502 {
 						fmt.Printf("Got a %d from %s.\n", statusCode, uri)
 					} else {
-						endpoints = append(endpoints, EndpointState{URL: uri, Method: "GET", Code: statusCode, Headers: headers, PodSelector: service.Spec.Selector})
+						topology := discoverTopology(ctx, clientset, ingress.Namespace, serviceName)
+						fmt.Printf("%s -> %s on %s\n", uri, topology.workload(), strings.Join(topology.nodes(), ", "))
+						endpoints = append(endpoints, EndpointState{URL: uri, Method: "GET", Code: statusCode, Headers: headers, PodSelector: service.Spec.Selector,
+							Namespace: ingress.Namespace, Workload: topology.workload(), Topology: topology})
 					}
 					defer resp.Body.Close()
 				}
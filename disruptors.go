@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Disruptor states, as reported by the control API
+const (
+	disruptorRunning  = "running"
+	disruptorSleeping = "sleeping"
+	disruptorWaiting  = "waiting"
+	disruptorPaused   = "paused"
+)
+
+type disruptorStatus struct {
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	Actions    int       `json:"actions"`
+	LastAction time.Time `json:"lastAction"`
+	NextAction time.Time `json:"nextAction"`
+}
+
+type registeredDisruptor struct {
+	// Held for the duration of an action, so a triggered action never overlaps a scheduled one
+	action sync.Mutex
+	once   func()
+	status disruptorStatus
+}
+
+// disruptorRegistry tracks the running disruptors, so they can be listed and triggered on demand
+type disruptorRegistry struct {
+	lock  sync.Mutex
+	items map[string]*registeredDisruptor
+}
+
+var disruptors = disruptorRegistry{items: map[string]*registeredDisruptor{}}
+
+func (registry *disruptorRegistry) register(name string, once func()) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.items[name] = &registeredDisruptor{once: once, status: disruptorStatus{Name: name, NextAction: time.Now()}}
+}
+
+func (registry *disruptorRegistry) get(name string) (disruptor *registeredDisruptor, err error) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	disruptor, found := registry.items[name]
+	if !found {
+		return nil, fmt.Errorf("disruptor %s is not running", name)
+	}
+	return disruptor, nil
+}
+
+func (registry *disruptorRegistry) execute(disruptor *registeredDisruptor) {
+	defer disruptor.action.Unlock()
+	registry.lock.Lock()
+	disruptor.status.State = disruptorRunning
+	registry.lock.Unlock()
+
+	disruptor.once()
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	disruptor.status.State = ""
+	disruptor.status.Actions++
+	disruptor.status.LastAction = time.Now()
+}
+
+// run performs one action of a disruptor, waiting for a triggered action to finish first
+func (registry *disruptorRegistry) run(name string) {
+	disruptor, err := registry.get(name)
+	if err != nil {
+		return
+	}
+	disruptor.action.Lock()
+	registry.execute(disruptor)
+}
+
+// trigger starts one action of a disruptor in the background, unless it is already acting
+func (registry *disruptorRegistry) trigger(name string) (err error) {
+	disruptor, err := registry.get(name)
+	if err != nil {
+		return err
+	}
+	if !disruptor.action.TryLock() {
+		return fmt.Errorf("disruptor %s is already acting", name)
+	}
+	go registry.execute(disruptor)
+	return nil
+}
+
+// whileIdle runs a function unless the disruptor is acting, so it never interferes with an action under way
+func (registry *disruptorRegistry) whileIdle(name string, idle func()) {
+	disruptor, err := registry.get(name)
+	if err != nil || !disruptor.action.TryLock() {
+		return
+	}
+	defer disruptor.action.Unlock()
+	idle()
+}
+
+// sleep waits for the next scheduled action of a disruptor
+func (registry *disruptorRegistry) sleep(name string, duration time.Duration) {
+	registry.lock.Lock()
+	if disruptor, found := registry.items[name]; found {
+		disruptor.status.NextAction = time.Now().Add(duration)
+	}
+	registry.lock.Unlock()
+	time.Sleep(duration)
+}
+
+func (registry *disruptorRegistry) list() (statuses []disruptorStatus) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	paused := killSwitch.isPaused()
+	statuses = []disruptorStatus{}
+	for _, disruptor := range registry.items {
+		status := disruptor.status
+		if status.State == "" {
+			switch {
+			case paused:
+				status.State = disruptorPaused
+			case time.Now().Before(status.NextAction):
+				status.State = disruptorSleeping
+			default:
+				// Past its next action, the disruptor waits for the schedule
+				status.State = disruptorWaiting
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
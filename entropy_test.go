@@ -1,9 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func Test_ValidateHttpCodes(t *testing.T) {
@@ -28,3 +43,743 @@ func Test_loadConfig(t *testing.T) {
 	assert.Equal(t, true, dc.Nodes.Enabled)
 	assert.Equal(t, true, dc.Ingress.Protocol == "https")
 }
+
+func Test_Guardrails(t *testing.T) {
+	safety := SafetyConfiguration{DeniedNamespaces: []string{"docker"}, ProtectedLabels: []string{"tier=db"}}
+	assert.Equal(t, "", namespaceRefusal(safety, "default"))
+	assert.NotEqual(t, "", namespaceRefusal(safety, "docker"))
+	assert.NotEqual(t, "", namespaceRefusal(safety, "kube-system"))
+	assert.Equal(t, "", namespaceRefusal(SafetyConfiguration{AllowedNamespaces: []string{"kube-system"}}, "kube-system"))
+	assert.NotEqual(t, "", namespaceRefusal(SafetyConfiguration{AllowedNamespaces: []string{"test"}}, "default"))
+
+	assert.Equal(t, "", objectRefusal(safety, map[string]string{"tier": "web"}, nil))
+	assert.NotEqual(t, "", objectRefusal(safety, map[string]string{"tier": "db"}, nil))
+	assert.NotEqual(t, "", objectRefusal(safety, nil, map[string]string{"kube-entropy.io/exclude": "true"}))
+}
+
+func Test_Overrides(t *testing.T) {
+	overrides := readOverrides("pod", "test.nginx", map[string]string{"kube-entropy.io/interval": "10m", "kube-entropy.io/max-disruption": "1"})
+	assert.Equal(t, 10*time.Minute, overrides.Interval)
+	assert.Equal(t, 1, overrides.MaxDisruption)
+	assert.Equal(t, -1, readOverrides("pod", "test.nginx", map[string]string{"kube-entropy.io/max-disruption": "x"}).MaxDisruption)
+
+	assert.Equal(t, true, checkOverrides(overrides, "pod", "test.nginx", "test/ReplicaSet/nginx", 0))
+	assert.Equal(t, false, checkOverrides(overrides, "pod", "test.nginx", "test/ReplicaSet/nginx", 1))
+	recordDisruption("test/ReplicaSet/nginx")
+	assert.Equal(t, false, checkOverrides(overrides, "pod", "test.nginx", "test/ReplicaSet/nginx", 0))
+}
+
+func Test_TerminationStrategies(t *testing.T) {
+	podConfig := PodConfiguration{
+		Termination: TerminationStrategy{Type: "graceful"},
+		Groups: []PodTargetGroup{
+			{Name: "kafka", Namespaces: []string{"kafka"}, Termination: TerminationStrategy{Type: "container"}},
+			{Name: "grafana", Ingresses: []string{"grafana"}, Termination: TerminationStrategy{Type: "gracePeriod", GracePeriodSeconds: 5}},
+		},
+	}
+	assert.Equal(t, "container", terminationFor(podConfig, IngressState{Name: "topics", Namespace: "kafka"}).Type)
+	assert.Equal(t, "gracePeriod", terminationFor(podConfig, IngressState{Name: "grafana", Namespace: "grafana"}).Type)
+	assert.Equal(t, "graceful", terminationFor(podConfig, IngressState{Name: "kibana", Namespace: "efk"}).Type)
+
+	options, err := deleteOptions(TerminationStrategy{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(0), *options.GracePeriodSeconds)
+	options, _ = deleteOptions(TerminationStrategy{Type: "graceful"})
+	assert.Equal(t, true, options.GracePeriodSeconds == nil)
+	options, _ = deleteOptions(TerminationStrategy{Type: "gracePeriod", GracePeriodSeconds: 5})
+	assert.Equal(t, int64(5), *options.GracePeriodSeconds)
+	_, err = deleteOptions(TerminationStrategy{Type: "nuke"})
+	assert.NotEqual(t, nil, err)
+}
+
+func testPod(name string, owner string, node string) v1.Pod {
+	controller := true
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: owner, Controller: &controller}}},
+		Spec: v1.PodSpec{NodeName: node},
+	}
+}
+
+func Test_SelectVictims(t *testing.T) {
+	pods := []v1.Pod{
+		testPod("a-1", "a", "node-1"), testPod("a-2", "a", "node-2"), testPod("a-3", "a", "node-3"),
+		testPod("b-1", "b", "node-1"), testPod("b-2", "b", "node-2"),
+	}
+	zones := map[string]string{"node-1": "east", "node-2": "east", "node-3": "west"}
+
+	assert.Equal(t, 1, len(selectVictims(PodSelection{}, pods, zones)))
+	assert.Equal(t, 0, len(selectVictims(PodSelection{}, []v1.Pod{}, zones)))
+	assert.Equal(t, 3, len(selectVictims(PodSelection{Mode: "count", Count: 3}, pods, zones)))
+	assert.Equal(t, 5, len(selectVictims(PodSelection{Mode: "count", Count: 10}, pods, zones)))
+	assert.Equal(t, 2, len(selectVictims(PodSelection{Mode: "percent", Percent: 30}, pods, zones)))
+	assert.Equal(t, 3, len(selectVictims(PodSelection{Mode: "perNode"}, pods, zones)))
+	assert.Equal(t, 2, len(selectVictims(PodSelection{Mode: "perZone"}, pods, zones)))
+	assert.Equal(t, 0, len(selectVictims(PodSelection{Mode: "all"}, pods, zones)))
+
+	workload := selectVictims(PodSelection{Mode: "workload"}, pods, zones)
+	for _, pod := range workload {
+		assert.Equal(t, podGroup(workload[0]), podGroup(pod))
+	}
+	assert.Contains(t, []int{2, 3}, len(workload))
+}
+
+func Test_Topology(t *testing.T) {
+	topology := EndpointTopology{Service: "web", Pods: []PodTopology{
+		{Name: "web-1", Node: "node-2", EndpointSlice: "web-x", Owners: []WorkloadReference{{Kind: "ReplicaSet", Name: "web-5d"}, {Kind: "Deployment", Name: "web"}}},
+		{Name: "web-2", Node: "node-1", EndpointSlice: "web-x", Owners: []WorkloadReference{{Kind: "ReplicaSet", Name: "web-5d"}, {Kind: "Deployment", Name: "web"}}},
+	}}
+	assert.Equal(t, []string{"node-1", "node-2"}, topology.nodes())
+	assert.Equal(t, WorkloadReference{Kind: "Deployment", Name: "web"}, topology.workload())
+
+	testPlan := ApplicationState{Monitoring: MonitoringConfiguration{Ingresses: IngressConfiguration{Items: []IngressState{
+		{Name: "web", Namespace: "test", Endpoints: []EndpointState{{URL: "http://web/", Namespace: "test", Workload: topology.workload(), Topology: topology}}},
+	}}}}
+	assert.Equal(t, []string{"http://web/"}, routesOnNode(testPlan, nil, "node-1"))
+	assert.Equal(t, 0, len(routesOnNode(testPlan, nil, "node-3")))
+	// Live placement wins over the discovered topology
+	placement := map[string][]string{"http://web/": {"node-3"}}
+	assert.Equal(t, 0, len(routesOnNode(testPlan, placement, "node-1")))
+	assert.Equal(t, []string{"http://web/"}, routesOnNode(testPlan, placement, "node-3"))
+	// Without any namespace the pods aren't listed cluster wide, the discovered topology is kept
+	unscoped := ApplicationState{Monitoring: MonitoringConfiguration{Ingresses: IngressConfiguration{Items: []IngressState{
+		{Name: "web", Endpoints: []EndpointState{{URL: "http://web/", PodSelector: map[string]string{"app": "web"}, Topology: topology}}},
+	}}}}
+	assert.Equal(t, map[string][]string{"http://web/": {"node-1", "node-2"}}, livePlacement(context.Background(), nil, unscoped))
+	assert.Equal(t, []string{"http://web/"}, routesOfWorkload(testPlan, "test", WorkloadReference{Kind: "Deployment", Name: "web"}))
+
+	var dot bytes.Buffer
+	printTopologyDot(testPlan, &dot)
+	assert.Contains(t, dot.String(), `"pod web-1" -> "ReplicaSet/web-5d";`)
+	assert.Contains(t, dot.String(), `"pod web-2" -> "node node-1";`)
+}
+
+func Test_Timeline(t *testing.T) {
+	web := EndpointState{URL: "http://web/", Namespace: "test", PodSelector: map[string]string{"app": "web"},
+		Topology: EndpointTopology{Pods: []PodTopology{{Name: "web-1", Node: "node-1"}}}}
+	api := EndpointState{URL: "http://api/", Namespace: "test", PodSelector: map[string]string{"app": "api"}}
+	ingress := IngressState{Name: "web", Namespace: "test"}
+
+	events := eventTimeline{open: map[string]*outage{}}
+	events.recordDisruption(disruptionEvent{Action: "pod deletion", Namespace: "test", Pods: []disruptedPod{{Name: "web-1", Labels: map[string]string{"app": "web", "pod-template-hash": "5d"}}}})
+	events.recordDisruption(disruptionEvent{Action: "node cordon", Nodes: []string{"node-2"}})
+
+	events.recordProbe(ingress, web, false)
+	events.recordProbe(ingress, web, false)
+	events.recordProbe(ingress, api, false)
+	events.recordProbe(ingress, web, true)
+
+	assert.Equal(t, 2, len(events.outages))
+	assert.Equal(t, 1, events.outages[0].DisruptionID)
+	assert.Equal(t, 2, events.outages[0].Failures)
+	assert.Equal(t, true, events.outages[0].recovered())
+	assert.Equal(t, 0, events.outages[1].DisruptionID)
+
+	events.recordDisruption(disruptionEvent{Action: "node cordon", Nodes: []string{"node-1"}})
+	events.recordProbe(ingress, web, false)
+	assert.Equal(t, 3, events.outages[2].DisruptionID)
+
+	// Failures long after a disruption aren't blamed on it
+	events.recordProbe(ingress, web, true)
+	events.disruptions[2].Time = time.Now().Add(-time.Hour)
+	events.recordProbe(ingress, web, false)
+	assert.Equal(t, 0, events.outages[3].DisruptionID)
+
+	var report bytes.Buffer
+	events.printReport(&report)
+	assert.Contains(t, report.String(), "pod deletion test.web-1\n  -> http://web/ (test.web) recovered after")
+	assert.Contains(t, report.String(), "node cordon node-2\n  -> no endpoints affected")
+	assert.Contains(t, report.String(), "Failures not attributed to a disruption\n  -> http://api/ (test.web) not recovered")
+}
+
+func Test_MeasureRecovery(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 && requests <= 4 {
+			w.WriteHeader(502)
+		}
+	}))
+	defer server.Close()
+
+	target := monitoredEndpoint{ingress: IngressState{Name: "web", Namespace: "test"}, endpoint: EndpointState{URL: server.URL, Code: 200}}
+	config := RecoveryConfiguration{Interval: time.Millisecond, FailureWindow: time.Second, Timeout: 5 * time.Second}
+	measurement := measureRecovery(config, disruptionEvent{ID: 7, Time: time.Now()}, target)
+	assert.Equal(t, true, measurement.Impacted)
+	assert.Equal(t, true, measurement.Recovered)
+	assert.Equal(t, 3, measurement.FailedRequests)
+	assert.Equal(t, 7, measurement.DisruptionID)
+
+	recordRecovery(measurement)
+	recordRecovery(recoveryMeasurement{Ingress: "test.web", URL: server.URL, Impacted: true, Recovered: true, Outage: time.Second})
+	assert.Equal(t, (measurement.Outage+time.Second)/2, recoveryStats["test.web"].mttr())
+
+	var out bytes.Buffer
+	metrics.write(&out)
+	assert.Contains(t, out.String(), "# TYPE kube_entropy_mttr_seconds gauge\nkube_entropy_mttr_seconds{ingress=\"test.web\"}")
+}
+
+func Test_LoadStatistics(t *testing.T) {
+	endpoint := EndpointState{URL: "http://web/", Code: 200, Headers: map[string]string{"Server": "nginx"}}
+	assert.Equal(t, "", categorizeResponse(endpoint, &http.Response{StatusCode: 200, Header: http.Header{"Server": []string{"nginx"}}}, nil))
+	assert.Equal(t, "http_502", categorizeResponse(endpoint, &http.Response{StatusCode: 502}, nil))
+	assert.Equal(t, "headers", categorizeResponse(endpoint, &http.Response{StatusCode: 200, Header: http.Header{}}, nil))
+
+	load := &endpointLoad{
+		target:  monitoredEndpoint{ingress: IngressState{Name: "web", Namespace: "test"}, endpoint: endpoint},
+		current: loadSecond{Errors: map[string]int{}},
+		total:   loadSecond{Errors: map[string]int{}},
+	}
+	for i := 1; i <= 10; i++ {
+		load.record(time.Duration(i)*time.Millisecond, "")
+	}
+	load.record(0, "http_502")
+	load.record(0, "http_502")
+	assert.Equal(t, 5*time.Millisecond, load.current.percentile(0.5))
+	assert.Equal(t, 9*time.Millisecond, load.current.percentile(0.9))
+	assert.Equal(t, 10*time.Millisecond, load.current.percentile(0.99))
+	assert.Equal(t, "http_502=2", load.current.describeErrors())
+
+	load.flush()
+	assert.Equal(t, 12, load.total.Requests)
+	assert.InDelta(t, 10.0/12, load.worst.successRatio(), 0.001)
+	assert.Equal(t, 0, load.current.Requests)
+}
+
+func Test_UndoJournal(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "journal.yaml")
+	assert.Equal(t, nil, loadJournal(fileName))
+	first := journal.record(undoNetworkPolicy, "test", "kube-entropy-partition-1", nil)
+	second := journal.record(undoNetworkPolicy, "test", "kube-entropy-partition-2", map[string]string{"replicas": "3"})
+	journal.complete(first)
+
+	journal = undoJournal{}
+	assert.Equal(t, nil, loadJournal(fileName))
+	assert.Equal(t, 1, len(journal.pending()))
+	assert.Equal(t, second, journal.pending()[0].ID)
+	assert.Equal(t, "3", journal.pending()[0].Data["replicas"])
+	assert.Equal(t, second+1, journal.record(undoNetworkPolicy, "test", "kube-entropy-partition-3", nil))
+	journal = undoJournal{NextID: 1}
+}
+
+func Test_PartitionPolicy(t *testing.T) {
+	policy := partitionPolicy(NetworkConfiguration{}, "test", map[string]string{"app": "web"})
+	assert.Equal(t, "true", policy.Labels["kube-entropy.io/managed"])
+	assert.Equal(t, 2, len(policy.Spec.PolicyTypes))
+	assert.Equal(t, 0, len(policy.Spec.Ingress))
+	assert.Equal(t, 0, len(policy.Spec.Egress))
+
+	policy = partitionPolicy(NetworkConfiguration{Direction: "egress", Peers: []string{"10.0.0.0/8"}}, "test", map[string]string{"app": "web"})
+	assert.Equal(t, []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, policy.Spec.PolicyTypes)
+	assert.Equal(t, []string{"10.0.0.0/8"}, policy.Spec.Egress[0].To[0].IPBlock.Except)
+}
+
+func Test_InjectDNSFailure(t *testing.T) {
+	corefile := ".:53 {\n    errors\n    forward . /etc/resolv.conf\n}\n"
+
+	injected, err := injectDNSFailure(corefile, []string{"example.com"}, "servfail", "")
+	assert.Nil(t, err)
+	assert.Equal(t, ".:53 {\n    template ANY ANY example.com {\n        rcode SERVFAIL\n    }\n    errors\n    forward . /etc/resolv.conf\n}\n", injected)
+
+	injected, err = injectDNSFailure(corefile, []string{"example.com", "example.org"}, "delay", "10.0.0.5:5353")
+	assert.Nil(t, err)
+	assert.Contains(t, injected, "example.com:53 example.org:53 {\n    forward . 10.0.0.5:5353 {\n        prefer_udp\n    }\n}\n")
+	_, err = injectDNSFailure(corefile, []string{"example.com"}, "delay", "")
+	assert.NotNil(t, err)
+
+	_, err = injectDNSFailure(corefile, nil, "nxdomain", "")
+	assert.NotNil(t, err)
+	_, err = injectDNSFailure("example.com:53 {\n}\n", []string{"example.com"}, "nxdomain", "")
+	assert.NotNil(t, err)
+
+	_, err = corefileUpstream(corefile)
+	assert.NotNil(t, err)
+	upstream, err := corefileUpstream(".:53 {\n    forward . 8.8.8.8 1.1.1.1\n}\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "8.8.8.8:53", upstream)
+}
+
+func Test_DelayedDNS(t *testing.T) {
+	// The upstream resolver echoes the queries back
+	resolver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer resolver.Close()
+	go func() {
+		buffer := make([]byte, 512)
+		for true {
+			n, client, err := resolver.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			resolver.WriteTo(append([]byte("answer:"), buffer[:n]...), client)
+		}
+	}()
+
+	proxy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer proxy.Close()
+	go serveDelayedDNS(proxy, resolver.LocalAddr().String(), 200*time.Millisecond)
+
+	start := time.Now()
+	answer, err := exchangeDNS(proxy.LocalAddr().String(), []byte("query"), time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "answer:query", string(answer))
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
+
+func Test_FaultProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	proxy := newFaultProxy(ProxyConfiguration{Target: backend.URL, Latency: 50 * time.Millisecond, ErrorRate: 1, ErrorCode: 502})
+	handler, err := proxy.httpHandler()
+	assert.Nil(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	proxy.setFaulty(true)
+	start := time.Now()
+	resp, err = http.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 502, resp.StatusCode)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	resp.Body.Close()
+
+	proxy.config.ErrorRate = 0
+	proxy.config.ResetRate = 1
+	_, err = http.Get(server.URL)
+	assert.NotNil(t, err)
+}
+
+func Test_FaultProxyTCP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer backend.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	proxy := newFaultProxy(ProxyConfiguration{Protocol: "tcp", Target: backend.Listener.Addr().String(), Bandwidth: 1000})
+	go proxy.serve(listener)
+	proxy.setFaulty(true)
+
+	start := time.Now()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + listener.Addr().String())
+	assert.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(body))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func Test_WorkloadDisruption(t *testing.T) {
+	assert.Equal(t, 2, scaledReplicas(4, 0.5))
+	assert.Equal(t, 1, scaledReplicas(1, 0.5))
+	assert.Equal(t, 1, scaledReplicas(2, 0.1))
+	assert.Equal(t, 2, scaledReplicas(3, 0.9))
+	assert.Equal(t, 0, scaledReplicas(0, 0.5))
+
+	web := WorkloadReference{Kind: "Deployment", Name: "web"}
+	testPlan := ApplicationState{Monitoring: MonitoringConfiguration{Ingresses: IngressConfiguration{Items: []IngressState{
+		{Name: "a", Namespace: "shop", Endpoints: []EndpointState{{URL: "http://a/", Workload: web}, {URL: "http://a/b", Workload: web}}},
+		{Name: "b", Namespace: "shop", Endpoints: []EndpointState{{URL: "http://b/", Workload: WorkloadReference{Kind: "Pod", Name: "static"}}}},
+	}}}}
+	namespaces, workloads := scalableWorkloads(testPlan)
+	assert.Equal(t, []string{"shop"}, namespaces)
+	assert.Equal(t, []WorkloadReference{web}, workloads)
+
+	disruption := disruptionEvent{Action: "scale down", Namespace: "shop", Workloads: []WorkloadReference{web}}
+	assert.True(t, disruption.touches(EndpointState{Namespace: "shop", Workload: web}))
+	assert.False(t, disruption.touches(EndpointState{Namespace: "other", Workload: web}))
+	assert.Equal(t, "shop.Deployment/web", disruption.targets())
+}
+
+func Test_NodeTaint(t *testing.T) {
+	nodeConfig := withTaintDefaults(NodeConfiguration{Mode: "taint"})
+	assert.Equal(t, "kube-entropy.io/disrupted", nodeConfig.Taint.Key)
+	assert.Equal(t, "NoSchedule", nodeConfig.Taint.Effect)
+	assert.Equal(t, 5*time.Minute, nodeConfig.Duration)
+
+	node := v1.Node{Spec: v1.NodeSpec{Taints: []v1.Taint{{Key: "kube-entropy.io/disrupted", Effect: v1.TaintEffectNoExecute}}}}
+	assert.True(t, hasTaint(node, "kube-entropy.io/disrupted", "NoExecute"))
+	assert.False(t, hasTaint(node, "kube-entropy.io/disrupted", "NoSchedule"))
+}
+
+func testNode(name string, zone string, cpu string, memory string) v1.Node {
+	return v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"topology.kubernetes.io/zone": zone}},
+		Status:     v1.NodeStatus{Allocatable: v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu), v1.ResourceMemory: resource.MustParse(memory)}},
+	}
+}
+
+func Test_SelectNodes(t *testing.T) {
+	a1, a2, b1 := testNode("a1", "a", "2", "4Gi"), testNode("a2", "a", "2", "4Gi"), testNode("b1", "b", "2", "4Gi")
+	candidates := []v1.Node{a1, a2, b1}
+
+	victims := selectNodes(NodeConfiguration{Selection: "zone"}, []v1.Node{a1, a2}, nil)
+	assert.Equal(t, 2, len(victims))
+
+	victims = selectNodes(NodeConfiguration{MaxPerZone: 1}, []v1.Node{a2, b1}, []v1.Node{a1})
+	assert.Equal(t, []v1.Node{b1}, victims)
+	assert.Equal(t, 0, len(selectNodes(NodeConfiguration{MaxPerZone: 1}, []v1.Node{a2}, []v1.Node{a1})))
+	assert.Equal(t, 1, len(selectNodes(NodeConfiguration{}, candidates, nil)))
+
+	pod := v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+		v1.ResourceCPU: resource.MustParse("1200m"), v1.ResourceMemory: resource.MustParse("1Gi")}}}}}}
+	pods := []v1.Pod{pod, pod, pod}
+	assert.Equal(t, "", capacityShortfall(candidates, []v1.Node{a1}, pods))
+	assert.NotEqual(t, "", capacityShortfall(candidates, []v1.Node{a1, a2}, pods))
+	pods[2].Status.Phase = v1.PodSucceeded
+	assert.Equal(t, "", capacityShortfall(candidates, []v1.Node{a1, a2}, pods[1:]))
+}
+
+func Test_NodeHealthGate(t *testing.T) {
+	ready := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue}
+	a, b := testNode("a", "a", "2", "4Gi"), testNode("b", "b", "2", "4Gi")
+	a.Status.Conditions = []v1.NodeCondition{ready}
+	b.Status.Conditions = []v1.NodeCondition{ready}
+	assert.Equal(t, "", clusterProblem(NodeConfiguration{MinReadyNodes: 2, MaxPendingPods: 5}, []v1.Node{a, b}, 5))
+	assert.Equal(t, "only 2 Ready schedulable nodes, minimum is 3", clusterProblem(NodeConfiguration{MinReadyNodes: 3}, []v1.Node{a, b}, 0))
+	assert.Equal(t, "6 pods are Pending, maximum is 5", clusterProblem(NodeConfiguration{MaxPendingPods: 5}, []v1.Node{a, b}, 6))
+
+	b.Status.Conditions = append(b.Status.Conditions, v1.NodeCondition{Type: v1.NodeDiskPressure, Status: v1.ConditionTrue})
+	assert.Equal(t, "node b is under DiskPressure", clusterProblem(NodeConfiguration{}, []v1.Node{a, b}, 0))
+	b.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionUnknown}}
+	assert.Equal(t, "node b is NotReady", clusterProblem(NodeConfiguration{}, []v1.Node{a, b}, 0))
+}
+
+func Test_StressPod(t *testing.T) {
+	pod, err := stressPod(withStressDefaults(StressConfiguration{CPU: 2, Memory: "64Mi"}), "node-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1", pod.Spec.NodeName)
+	assert.Equal(t, "default", pod.Namespace)
+	assert.Equal(t, "true", pod.Labels["kube-entropy.io/managed"])
+	assert.Equal(t, "cpu,memory", pod.Annotations["kube-entropy.io/stress"])
+	assert.Equal(t, []string{"-mode", "stress", "-stress-duration", "2m0s", "-stress-dir", "/stress", "-stress-cpu", "2", "-stress-memory", "64Mi"}, pod.Spec.Containers[0].Args)
+	// Only the limits match the load, requesting it would reserve the capacity instead of pressuring the node
+	assert.Equal(t, "10m", pod.Spec.Containers[0].Resources.Requests.Cpu().String())
+	assert.Equal(t, "16Mi", pod.Spec.Containers[0].Resources.Requests.Memory().String())
+	assert.Equal(t, "2", pod.Spec.Containers[0].Resources.Limits.Cpu().String())
+	assert.Equal(t, "128Mi", pod.Spec.Containers[0].Resources.Limits.Memory().String())
+	assert.Equal(t, "alexlokshin/kube-entropy:"+version, pod.Spec.Containers[0].Image)
+
+	_, err = stressPod(StressConfiguration{Memory: "lots"}, "node-1")
+	assert.NotNil(t, err)
+	_, err = stressPod(StressConfiguration{}, "node-1")
+	assert.NotNil(t, err)
+
+	dir := t.TempDir()
+	assert.Nil(t, runStress(stressLoad{CPU: 1, Memory: 1024 * 1024, Disk: 1024 * 1024, Duration: 10 * time.Millisecond, Dir: dir}))
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(t, 0, len(files))
+}
+
+func Test_ControllerSelector(t *testing.T) {
+	nginx := networkingv1.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: "nginx"}, Spec: networkingv1.IngressClassSpec{Controller: "k8s.io/ingress-nginx"}}
+	traefik := networkingv1.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: "traefik", Annotations: map[string]string{"ingressclass.kubernetes.io/is-default-class": "true"}},
+		Spec: networkingv1.IngressClassSpec{Controller: "traefik.io/ingress-controller"}}
+	other := networkingv1.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: "other"}, Spec: networkingv1.IngressClassSpec{Controller: "example.com/other"}}
+
+	selector, err := controllerSelector([]networkingv1.IngressClass{nginx}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ingress-nginx", selector["app.kubernetes.io/name"])
+	selector, err = controllerSelector([]networkingv1.IngressClass{nginx, traefik}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "traefik", selector["app.kubernetes.io/name"])
+	selector, err = controllerSelector([]networkingv1.IngressClass{nginx, traefik}, "nginx")
+	assert.Nil(t, err)
+	assert.Equal(t, "controller", selector["app.kubernetes.io/component"])
+
+	_, err = controllerSelector([]networkingv1.IngressClass{nginx, other}, "")
+	assert.NotNil(t, err)
+	_, err = controllerSelector([]networkingv1.IngressClass{other}, "other")
+	assert.NotNil(t, err)
+
+	command, err := reloadCommand(IngressControllerConfiguration{}, "k8s.io/ingress-nginx")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"nginx", "-s", "reload"}, command)
+	_, err = reloadCommand(IngressControllerConfiguration{}, "traefik.io/ingress-controller")
+	assert.NotNil(t, err)
+	_, err = reloadCommand(IngressControllerConfiguration{}, "")
+	assert.NotNil(t, err)
+	command, err = reloadCommand(IngressControllerConfiguration{ReloadCommand: []string{"kill", "-HUP", "1"}}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kill", "-HUP", "1"}, command)
+}
+
+func Test_Schedule(t *testing.T) {
+	cron, err := parseCron("*/15 9-17 * * 1-5")
+	assert.Nil(t, err)
+	monday := time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)
+	assert.True(t, cron.matches(monday))
+	assert.False(t, cron.matches(monday.Add(time.Minute)))
+	assert.False(t, cron.matches(monday.AddDate(0, 0, -1)))
+	_, err = parseCron("* * * *")
+	assert.NotNil(t, err)
+	_, err = parseCron("61 * * * *")
+	assert.NotNil(t, err)
+	// A day of month covering every day still restricts to the weekdays, instead of matching either
+	cron, err = parseCron("30 9 1-31 * 1-5")
+	assert.Nil(t, err)
+	assert.True(t, cron.matches(monday))
+	assert.False(t, cron.matches(monday.AddDate(0, 0, -1)))
+	_, err = parseTimeOfDay("24:30", 0)
+	assert.NotNil(t, err)
+	midnight, err := parseTimeOfDay("24:00", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 24*time.Hour, midnight)
+
+	config := ScheduleConfiguration{Enabled: true, Timezone: "Europe/Berlin", MaxActions: 2,
+		Windows: []ScheduleWindow{{Weekdays: []string{"Mon", "Tue"}, From: "09:00", To: "17:00"}}, Blackouts: []string{"2026-10-20"}}
+	assert.Nil(t, validateSchedule(config))
+	start, reason := allowedWindow(config, monday)
+	assert.Equal(t, "", reason)
+	assert.Equal(t, time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), start.UTC())
+	_, reason = allowedWindow(config, monday.Add(8*time.Hour))
+	assert.Equal(t, "outside of the schedule windows", reason)
+	_, reason = allowedWindow(config, monday.AddDate(0, 0, 1))
+	assert.Equal(t, "blackout date 2026-10-20", reason)
+
+	overnight := ScheduleWindow{Weekdays: []string{"Sun"}, From: "22:00", To: "02:00"}
+	_, active, _ := overnight.activeSince(time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC))
+	assert.True(t, active)
+	hourly := ScheduleWindow{Cron: "0 * * * *", Duration: 10 * time.Minute}
+	_, active, _ = hourly.activeSince(monday.Add(-25 * time.Minute))
+	assert.True(t, active)
+	_, active, _ = hourly.activeSince(monday)
+	assert.False(t, active)
+	// Daylight saving time starts at 2am on 2026-03-08 in New York, the window still opens at 9am
+	newYork, _ := time.LoadLocation("America/New_York")
+	morning := ScheduleWindow{From: "09:00", To: "10:00"}
+	start, active, _ = morning.activeSince(time.Date(2026, 3, 8, 9, 30, 0, 0, newYork))
+	assert.True(t, active)
+	assert.Equal(t, 9, start.Hour())
+
+	gate := scheduleGate{actions: map[int64]int{}}
+	allowed, _ := gate.acquire(config, monday)
+	assert.True(t, allowed)
+	allowed, _ = gate.acquire(config, monday.Add(time.Hour))
+	assert.True(t, allowed)
+	allowed, _ = gate.acquire(config, monday.Add(2*time.Hour))
+	assert.False(t, allowed)
+	assert.NotNil(t, validateSchedule(ScheduleConfiguration{Blackouts: []string{"tomorrow"}}))
+	assert.NotNil(t, validateSchedule(ScheduleConfiguration{Windows: []ScheduleWindow{{Weekdays: []string{"Mon", "Funday"}}}}))
+}
+
+func Test_KillSwitch(t *testing.T) {
+	switchConfig := withKillSwitchDefaults(KillSwitchConfiguration{Namespace: "chaos"})
+	assert.Equal(t, "kube-entropy-control", switchConfig.ConfigMap)
+	assert.Equal(t, "", pausedBy(switchConfig, nil, nil))
+	assert.Equal(t, "", pausedBy(switchConfig, map[string]string{"state": "running"}, nil))
+	assert.Equal(t, "configmap chaos.kube-entropy-control", pausedBy(switchConfig, map[string]string{"state": " Paused\n"}, nil))
+	assert.Equal(t, "namespace chaos", pausedBy(switchConfig, nil, map[string]string{"kube-entropy.io/state": "paused"}))
+
+	s := pauseSwitch{sources: map[string]bool{}}
+	assert.False(t, s.isPaused())
+	assert.True(t, s.set(pauseSourceKillSwitch, true))
+	assert.False(t, s.set(pauseSourceKillSwitch, true))
+	assert.True(t, s.isPaused())
+	assert.True(t, s.set(pauseSourceAPI, true))
+	assert.Equal(t, []string{pauseSourceAPI, pauseSourceKillSwitch}, s.activeSources())
+	assert.True(t, s.set(pauseSourceKillSwitch, false))
+	assert.True(t, s.isPaused())
+	assert.True(t, s.set(pauseSourceAPI, false))
+	assert.False(t, s.isPaused())
+
+	// Disruptions are held until the duration passes or the run is paused
+	assert.True(t, sleepUnlessPaused(10*time.Millisecond))
+	killSwitch.set(pauseSourceKillSwitch, true)
+	start := time.Now()
+	assert.False(t, sleepUnlessPaused(time.Minute))
+	assert.True(t, time.Since(start) < time.Second)
+	killSwitch.set(pauseSourceKillSwitch, false)
+}
+
+func Test_ControlAPI(t *testing.T) {
+	_, err := newControlAPI(context.Background(), ApplicationState{API: ControlAPIConfiguration{Enabled: true, TokenReview: true}}, nil)
+	assert.NotNil(t, err)
+
+	api := &controlAPI{testPlan: ApplicationState{API: ControlAPIConfiguration{Enabled: true}}, token: "secret"}
+	mux := http.NewServeMux()
+	api.routes(mux)
+	request := func(method string, path string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/v1/plan", "").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/plan", "secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/v1/status", "").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/api/v1/probes", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/api/v1/pause", "secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/api/v1/pause", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/api/v1/pause", "wrong").Code)
+
+	triggered := make(chan bool, 1)
+	disruptors.register("test", func() { triggered <- true })
+	defer func() {
+		disruptors.lock.Lock()
+		delete(disruptors.items, "test")
+		disruptors.lock.Unlock()
+	}()
+
+	assert.Equal(t, http.StatusOK, request("POST", "/api/v1/pause", "secret").Code)
+	assert.True(t, killSwitch.isPaused())
+	assert.Contains(t, request("GET", "/api/v1/status", "secret").Body.String(), `"pausedBy":["api"]`)
+	assert.Equal(t, http.StatusConflict, request("POST", "/api/v1/disruptors/test/trigger", "secret").Code)
+	assert.Equal(t, http.StatusOK, request("POST", "/api/v1/resume", "secret").Code)
+	assert.False(t, killSwitch.isPaused())
+
+	assert.Equal(t, http.StatusNotFound, request("POST", "/api/v1/disruptors/missing/trigger", "secret").Code)
+	assert.Equal(t, http.StatusAccepted, request("POST", "/api/v1/disruptors/test/trigger", "secret").Code)
+	select {
+	case <-triggered:
+	case <-time.After(time.Second):
+		t.Error("disruptor wasn't triggered")
+	}
+	assert.Contains(t, request("GET", "/api/v1/disruptors", "").Body.String(), `"name":"test"`)
+
+	// Idle work waits for the action under way
+	registry := disruptorRegistry{items: map[string]*registeredDisruptor{}}
+	registry.register("nodes", func() {})
+	acting, _ := registry.get("nodes")
+	idled := 0
+	acting.action.Lock()
+	registry.whileIdle("nodes", func() { idled++ })
+	acting.action.Unlock()
+	registry.whileIdle("nodes", func() { idled++ })
+	assert.Equal(t, 1, idled)
+}
+
+func Test_SteadyState(t *testing.T) {
+	ingress := IngressState{Name: "shop", Namespace: "default"}
+	web := EndpointState{URL: "http://shop/web"}
+	config := SteadyStateConfiguration{MinSuccessRatio: 0.9, Window: time.Minute, MaxOutage: time.Hour}
+
+	events := eventTimeline{open: map[string]*outage{}}
+	assert.Equal(t, steadyStateUnknown, events.steadyState(config, time.Now()).Verdict)
+	for i := 0; i < 19; i++ {
+		events.recordProbe(ingress, web, true)
+	}
+	events.recordProbe(ingress, web, false)
+	assert.Equal(t, steadyStateSteady, events.steadyState(config, time.Now()).Verdict)
+	events.recordProbe(ingress, web, false)
+	events.recordProbe(ingress, web, false)
+	verdict := events.steadyState(config, time.Now())
+	assert.Equal(t, steadyStateBreached, verdict.Verdict)
+	assert.Contains(t, verdict.Reasons[0], "http://shop/web succeeded in 86.4%")
+
+	// Probes past the window don't count, but an outage longer than allowed does
+	config.MaxOutage = time.Minute
+	verdict = events.steadyState(config, time.Now().Add(2*time.Minute))
+	assert.Equal(t, steadyStateBreached, verdict.Verdict)
+	assert.Equal(t, []string{"http://shop/web is down for 2m0s, longer than 1m0s"}, verdict.Reasons)
+	events.recordProbe(ingress, web, true)
+	verdict = events.steadyState(config, time.Now())
+	assert.Len(t, verdict.Reasons, 1)
+	assert.Contains(t, verdict.Reasons[0], "succeeded in")
+}
+
+func Test_Dashboard(t *testing.T) {
+	api := &controlAPI{testPlan: ApplicationState{Monitoring: MonitoringConfiguration{Ingresses: IngressConfiguration{Items: []IngressState{
+		{Name: "shop", Namespace: "default", Endpoints: []EndpointState{{URL: "http://shop/web"}}}}}}}}
+	mux := http.NewServeMux()
+	api.routes(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "/api/v1/dashboard")
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/dashboard", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"url":"http://shop/web"`)
+	assert.Contains(t, w.Body.String(), `"steadyState":{"verdict"`)
+}
+
+func Test_Webhooks(t *testing.T) {
+	received := make(chan string, 10)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Header.Get("X-Team") + " " + string(body)
+	}))
+	defer server.Close()
+
+	_, err := newWebhookNotifier(WebhookConfiguration{URL: server.URL, Format: "teams"})
+	assert.NotNil(t, err)
+	_, err = newWebhookNotifier(WebhookConfiguration{URL: server.URL, Template: "{{.Message"})
+	assert.NotNil(t, err)
+
+	slack, err := newWebhookNotifier(WebhookConfiguration{URL: server.URL, Format: webhookSlack, Backoff: time.Millisecond,
+		Template: ":boom: {{.Event}} {{.Data.url}}", Headers: map[string]string{"X-Team": "sre"}, Events: []string{eventEndpointDown}})
+	assert.Nil(t, err)
+	assert.False(t, slack.accepts(eventDisruption))
+	assert.True(t, slack.accepts(eventEndpointDown))
+	slack.deliver(notification{Event: eventEndpointDown, Message: "down", Data: map[string]string{"url": "http://shop/web"}})
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, `sre {"text":":boom: endpoint_down http://shop/web"}`, <-received)
+
+	generic, err := newWebhookNotifier(WebhookConfiguration{URL: server.URL})
+	assert.Nil(t, err)
+	body, err := generic.payload(notification{Event: eventRunStarted, Message: "started", Data: map[string]string{}})
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"event":"run_started"`)
+	assert.Contains(t, string(body), `"message":"started"`)
+
+	// Client errors aren't retried
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	generic.config.URL = rejecting.URL
+	retry, err := generic.post(body)
+	assert.NotNil(t, err)
+	assert.False(t, retry)
+
+	// Secrets come from files or the environment and never show up in the plan
+	t.Setenv("TEST_WEBHOOK_URL", server.URL+"/hook")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("Bearer s3cret\n"), 0600))
+	secret := WebhookConfiguration{URLEnv: "TEST_WEBHOOK_URL", HeaderFiles: map[string]string{"Authorization": tokenFile}}
+	notifier, err := newWebhookNotifier(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL+"/hook", notifier.config.URL)
+	assert.Equal(t, "Bearer s3cret", notifier.config.Headers["Authorization"])
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://"), notifier.config.Name)
+	_, err = newWebhookNotifier(WebhookConfiguration{URLEnv: "TEST_WEBHOOK_MISSING"})
+	assert.NotNil(t, err)
+	plan, _ := json.Marshal(WebhookConfiguration{URL: "https://hooks.example.com/T000/XXXX", Headers: map[string]string{"Authorization": "Bearer s3cret"}})
+	assert.NotContains(t, string(plan), "XXXX")
+	assert.NotContains(t, string(plan), "s3cret")
+}
+
+func Test_ValidateTerminations(t *testing.T) {
+	assert.Nil(t, validateTerminations(PodConfiguration{Termination: TerminationStrategy{Type: terminationGraceful}}))
+	assert.NotNil(t, validateTerminations(PodConfiguration{Termination: TerminationStrategy{Type: "drain"}}))
+	assert.Nil(t, validateTermination(TerminationStrategy{Type: terminationContainer, Signal: "INT"}))
+	err := validateTerminations(PodConfiguration{Groups: []PodTargetGroup{{Name: "kafka", Termination: TerminationStrategy{Type: terminationContainer, Signal: "SIGKILL"}}}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "group kafka")
+}
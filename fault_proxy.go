@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+type ProxyConfiguration struct {
+	Enabled   bool          `yaml:"enabled"`
+	Name      string        `yaml:"name"`
+	Protocol  string        `yaml:"protocol"`
+	Listen    string        `yaml:"listen"`
+	Target    string        `yaml:"target"`
+	Interval  time.Duration `yaml:"interval"`
+	Duration  time.Duration `yaml:"duration"`
+	Latency   time.Duration `yaml:"latency"`
+	Jitter    time.Duration `yaml:"jitter"`
+	ResetRate float64       `yaml:"resetRate"`
+	ErrorRate float64       `yaml:"errorRate"`
+	ErrorCode int           `yaml:"errorCode"`
+	Bandwidth int           `yaml:"bandwidth"`
+}
+
+// faultProxy forwards traffic to a target, injecting faults while they are switched on
+type faultProxy struct {
+	config ProxyConfiguration
+	active int32
+}
+
+func newFaultProxy(config ProxyConfiguration) *faultProxy {
+	if config.Protocol == "" {
+		config.Protocol = "http"
+	}
+	if config.Name == "" {
+		config.Name = config.Listen
+	}
+	if config.ErrorCode == 0 {
+		config.ErrorCode = http.StatusServiceUnavailable
+	}
+	if config.Duration <= 0 {
+		config.Duration = time.Minute
+	}
+	return &faultProxy{config: config}
+}
+
+func (proxy *faultProxy) faulty() bool {
+	return atomic.LoadInt32(&proxy.active) == 1 && !killSwitch.isPaused()
+}
+
+func (proxy *faultProxy) setFaulty(faulty bool) {
+	value := 0.0
+	if faulty {
+		value = 1
+		atomic.StoreInt32(&proxy.active, 1)
+	} else {
+		atomic.StoreInt32(&proxy.active, 0)
+	}
+	metrics.setGauge("kube_entropy_proxy_faults_active", "Whether a fault proxy is injecting faults.", map[string]string{"proxy": proxy.config.Name}, value)
+}
+
+func (proxy *faultProxy) delay() time.Duration {
+	delay := proxy.config.Latency
+	if proxy.config.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(2*proxy.config.Jitter.Nanoseconds())) - proxy.config.Jitter
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+func (proxy *faultProxy) countFault(fault string) {
+	metrics.addCounter("kube_entropy_proxy_faults_total", "Faults injected by a fault proxy.", map[string]string{"proxy": proxy.config.Name, "fault": fault}, 1)
+}
+
+// throttledWriter limits the throughput of a writer to a number of bytes per second
+type throttledWriter struct {
+	writer         io.Writer
+	bytesPerSecond int
+}
+
+func (w throttledWriter) Write(data []byte) (written int, err error) {
+	chunk := w.bytesPerSecond / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	for written < len(data) {
+		end := written + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := w.writer.Write(data[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if flusher, ok := w.writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(w.bytesPerSecond))
+	}
+	return written, nil
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	throttled throttledWriter
+}
+
+func (w throttledResponseWriter) Write(data []byte) (int, error) {
+	return w.throttled.Write(data)
+}
+
+func (proxy *faultProxy) httpHandler() (handler http.Handler, err error) {
+	target, err := url.Parse(proxy.config.Target)
+	if err != nil {
+		return nil, err
+	}
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !proxy.faulty() {
+			reverseProxy.ServeHTTP(w, r)
+			return
+		}
+
+		time.Sleep(proxy.delay())
+		if rand.Float64() < proxy.config.ResetRate {
+			proxy.countFault("reset")
+			if hijacker, ok := w.(http.Hijacker); ok {
+				conn, _, err := hijacker.Hijack()
+				if err == nil {
+					resetConnection(conn)
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if rand.Float64() < proxy.config.ErrorRate {
+			proxy.countFault("error")
+			http.Error(w, http.StatusText(proxy.config.ErrorCode), proxy.config.ErrorCode)
+			return
+		}
+		if proxy.config.Bandwidth > 0 {
+			w = throttledResponseWriter{ResponseWriter: w, throttled: throttledWriter{writer: w, bytesPerSecond: proxy.config.Bandwidth}}
+		}
+		reverseProxy.ServeHTTP(w, r)
+	}), nil
+}
+
+// resetConnection closes a connection with a RST instead of a FIN when possible
+func resetConnection(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (proxy *faultProxy) serveTCPConnection(client net.Conn) {
+	if proxy.faulty() {
+		time.Sleep(proxy.delay())
+		if rand.Float64() < proxy.config.ResetRate {
+			proxy.countFault("reset")
+			resetConnection(client)
+			return
+		}
+	}
+
+	server, err := net.Dial("tcp", proxy.config.Target)
+	if err != nil {
+		log.Printf("ERROR: Proxy %s cannot connect to %s: %v\n", proxy.config.Name, proxy.config.Target, err)
+		client.Close()
+		return
+	}
+	defer server.Close()
+	defer client.Close()
+
+	var toClient io.Writer = client
+	if proxy.faulty() && proxy.config.Bandwidth > 0 {
+		toClient = throttledWriter{writer: client, bytesPerSecond: proxy.config.Bandwidth}
+	}
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(server, client)
+		done <- true
+	}()
+	go func() {
+		io.Copy(toClient, server)
+		done <- true
+	}()
+	<-done
+}
+
+func (proxy *faultProxy) serveTCP(listener net.Listener) (err error) {
+	for true {
+		client, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go proxy.serveTCPConnection(client)
+	}
+	return nil
+}
+
+// serve accepts connections on a listener, forwarding them to the target
+func (proxy *faultProxy) serve(listener net.Listener) (err error) {
+	switch proxy.config.Protocol {
+	case "http":
+		handler, err := proxy.httpHandler()
+		if err != nil {
+			return err
+		}
+		return http.Serve(listener, handler)
+	case "tcp":
+		return proxy.serveTCP(listener)
+	}
+	return fmt.Errorf("unknown proxy protocol %s", proxy.config.Protocol)
+}
+
+// scheduleFaults switches the faults on for a duration after every random interval.
+// Without an interval the faults are always on.
+func (proxy *faultProxy) scheduleFaults(testPlan ApplicationState) {
+	if proxy.config.Interval <= 0 {
+		log.Printf("Proxy %s injects faults permanently.\n", proxy.config.Name)
+		proxy.setFaulty(true)
+		return
+	}
+	proxy.setFaulty(false)
+	for true {
+		duration := time.Duration(rand.Int63n(proxy.config.Interval.Nanoseconds())) * time.Nanosecond
+		log.Printf("For next proxy faults of %s sleeping for %s\n", proxy.config.Name, duration)
+		time.Sleep(duration)
+		waitForSchedule(testPlan, "proxy "+proxy.config.Name)
+
+		log.Printf("Proxy %s injects faults for %s\n", proxy.config.Name, proxy.config.Duration)
+		proxy.setFaulty(true)
+		reportDisruption(testPlan, disruptionEvent{Action: "proxy faults", Objects: []string{proxy.config.Name + " -> " + proxy.config.Target}})
+		time.Sleep(proxy.config.Duration)
+		log.Printf("Proxy %s stops injecting faults\n", proxy.config.Name)
+		proxy.setFaulty(false)
+	}
+}
+
+func runFaultProxy(testPlan ApplicationState, config ProxyConfiguration) {
+	proxy := newFaultProxy(config)
+	listener, err := net.Listen("tcp", proxy.config.Listen)
+	if err != nil {
+		log.Printf("ERROR: Proxy %s cannot listen on %s: %v\n", proxy.config.Name, proxy.config.Listen, err)
+		return
+	}
+	log.Printf("Proxying %s traffic from %s to %s.\n", proxy.config.Protocol, proxy.config.Listen, proxy.config.Target)
+	go proxy.scheduleFaults(testPlan)
+	err = proxy.serve(listener)
+	if err != nil {
+		log.Printf("ERROR: Proxy %s stopped: %v\n", proxy.config.Name, err)
+	}
+}
+
+func startFaultProxies(testPlan ApplicationState) {
+	for _, config := range testPlan.Disruption.Proxies {
+		if config.Enabled {
+			log.Printf("Launching the fault proxy on %s.\n", config.Listen)
+			go runFaultProxy(testPlan, config)
+		}
+	}
+}
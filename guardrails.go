@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	excludeMarker           = "kube-entropy.io/exclude=true"
+	optInMarker             = "kube-entropy.io/enabled=true"
+	intervalAnnotation      = "kube-entropy.io/interval"
+	maxDisruptionAnnotation = "kube-entropy.io/max-disruption"
+)
+
+// Namespaces that are never disrupted unless explicitly allowed
+var protectedNamespaces = []string{"kube-system", "kube-public"}
+
+type SafetyConfiguration struct {
+	AllowedNamespaces    []string `yaml:"allowedNamespaces"`
+	DeniedNamespaces     []string `yaml:"deniedNamespaces"`
+	ProtectedLabels      []string `yaml:"protectedLabels"`
+	ProtectedAnnotations []string `yaml:"protectedAnnotations"`
+	OptIn                bool     `yaml:"optIn"`
+}
+
+// disruptionOverrides are set by app teams through annotations on their objects or namespaces
+type disruptionOverrides struct {
+	Interval      time.Duration
+	MaxDisruption int
+}
+
+var lastDisruptions = map[string]time.Time{}
+var lastDisruptionsLock sync.Mutex
+
+func containsString(items []string, item string) bool {
+	for _, element := range items {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesMarker checks a key=value (or a bare key) marker against a set of labels or annotations
+func matchesMarker(values map[string]string, marker string) bool {
+	parts := strings.SplitN(marker, "=", 2)
+	value, found := values[strings.TrimSpace(parts[0])]
+	if !found {
+		return false
+	}
+	return len(parts) == 1 || strings.EqualFold(value, strings.TrimSpace(parts[1]))
+}
+
+func namespaceRefusal(safety SafetyConfiguration, namespace string) (reason string) {
+	if len(safety.AllowedNamespaces) > 0 && !containsString(safety.AllowedNamespaces, namespace) {
+		return fmt.Sprintf("namespace %s is not in the allowlist", namespace)
+	}
+	if containsString(safety.DeniedNamespaces, namespace) {
+		return fmt.Sprintf("namespace %s is in the denylist", namespace)
+	}
+	if containsString(protectedNamespaces, namespace) && !containsString(safety.AllowedNamespaces, namespace) {
+		return fmt.Sprintf("namespace %s is protected by default", namespace)
+	}
+	return ""
+}
+
+func objectRefusal(safety SafetyConfiguration, labels map[string]string, annotations map[string]string) (reason string) {
+	for _, marker := range append([]string{excludeMarker}, safety.ProtectedLabels...) {
+		if matchesMarker(labels, marker) {
+			return fmt.Sprintf("protected by label %s", marker)
+		}
+	}
+	for _, marker := range append([]string{excludeMarker}, safety.ProtectedAnnotations...) {
+		if matchesMarker(annotations, marker) {
+			return fmt.Sprintf("protected by annotation %s", marker)
+		}
+	}
+	return ""
+}
+
+// readOverrides parses the per-object annotations. MaxDisruption is -1 when not limited.
+func readOverrides(kind string, name string, annotations map[string]string) (overrides disruptionOverrides) {
+	overrides.MaxDisruption = -1
+	if value, found := annotations[intervalAnnotation]; found {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			log.Printf("ERROR: Invalid %s annotation on %s %s: %v\n", intervalAnnotation, kind, name, err)
+		} else {
+			overrides.Interval = interval
+		}
+	}
+	if value, found := annotations[maxDisruptionAnnotation]; found {
+		maxDisruption, err := strconv.Atoi(value)
+		if err != nil || maxDisruption < 0 {
+			log.Printf("ERROR: Invalid %s annotation on %s %s: %s\n", maxDisruptionAnnotation, kind, name, value)
+		} else {
+			overrides.MaxDisruption = maxDisruption
+		}
+	}
+	return
+}
+
+// checkGuardrails decides if an object can be disrupted. Every refusal is logged.
+// Annotations of the object take precedence over the ones of its namespace when reading the overrides.
+func checkGuardrails(ctx context.Context, clientset *kubernetes.Clientset, safety SafetyConfiguration, kind string, object metav1.Object) (allowed bool, overrides disruptionOverrides) {
+	name := object.GetName()
+	reason := ""
+	optedIn := matchesMarker(object.GetAnnotations(), optInMarker)
+	annotations := map[string]string{}
+	if namespace := object.GetNamespace(); namespace != "" {
+		name = namespace + "." + name
+		reason = namespaceRefusal(safety, namespace)
+		if reason == "" {
+			ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+			if err != nil {
+				reason = fmt.Sprintf("cannot verify namespace %s: %v", namespace, err)
+			} else if nsReason := objectRefusal(safety, ns.Labels, ns.Annotations); nsReason != "" {
+				reason = "namespace " + nsReason
+			} else {
+				optedIn = optedIn || matchesMarker(ns.Annotations, optInMarker)
+				for key, value := range ns.Annotations {
+					annotations[key] = value
+				}
+			}
+		}
+	}
+	if reason == "" {
+		reason = objectRefusal(safety, object.GetLabels(), object.GetAnnotations())
+	}
+	if reason == "" && safety.OptIn && !optedIn {
+		reason = fmt.Sprintf("not opted in with %s", optInMarker)
+	}
+
+	if reason != "" {
+		log.Printf("Guardrail: refusing to disrupt %s %s, %s.\n", kind, name, reason)
+		return false, overrides
+	}
+
+	for key, value := range object.GetAnnotations() {
+		annotations[key] = value
+	}
+	return true, readOverrides(kind, name, annotations)
+}
+
+// checkOverrides enforces the annotation overrides for a group of related objects (e.g. replicas of a workload).
+// unavailable is the number of objects in the group which are already disrupted.
+func checkOverrides(overrides disruptionOverrides, kind string, name string, group string, unavailable int) (allowed bool) {
+	reason := ""
+	if overrides.MaxDisruption >= 0 && unavailable >= overrides.MaxDisruption {
+		reason = fmt.Sprintf("%d of %s already disrupted, maximum is %d", unavailable, group, overrides.MaxDisruption)
+	}
+	if reason == "" && overrides.Interval > 0 {
+		lastDisruptionsLock.Lock()
+		last, found := lastDisruptions[group]
+		lastDisruptionsLock.Unlock()
+		if found && time.Since(last) < overrides.Interval {
+			reason = fmt.Sprintf("%s was disrupted %s ago, interval is %s", group, time.Since(last).Round(time.Second), overrides.Interval)
+		}
+	}
+
+	if reason != "" {
+		log.Printf("Guardrail: refusing to disrupt %s %s, %s.\n", kind, name, reason)
+		return false
+	}
+	return true
+}
+
+func recordDisruption(group string) {
+	lastDisruptionsLock.Lock()
+	defer lastDisruptionsLock.Unlock()
+	lastDisruptions[group] = time.Now()
+}
@@ -67,35 +67,45 @@ func getIngressHost(dc discoveryConfig, ingress v1beta1.Ingress, rule v1beta1.In
 	return host
 }
 
+var probeClient = &http.Client{Timeout: 10 * time.Second}
+
+// probeEndpoint calls an endpoint and verifies the response matches the test plan
+func probeEndpoint(endpoint EndpointState) (err error) {
+	resp, err := probeClient.Get(endpoint.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = isMatchingResponse(endpoint, resp)
+	return err
+}
+
+type monitoredEndpoint struct {
+	ingress  IngressState
+	endpoint EndpointState
+}
+
 func validateIngresses(testPlan ApplicationState) (result bool) {
 	result = true
 	ingresses := testPlan.Monitoring.Ingresses.Items
-	endpoints := []EndpointState{}
+	endpoints := []monitoredEndpoint{}
 	for _, ingress := range ingresses {
 		for _, endpoint := range ingress.Endpoints {
-			endpoints = append(endpoints, endpoint)
+			endpoints = append(endpoints, monitoredEndpoint{ingress: ingress, endpoint: endpoint})
 		}
 	}
 
 	channel := make(chan bool, len(endpoints))
 
 	for _, endpoint := range endpoints {
-		go func(ep EndpointState, channel chan bool) {
-			resp, err := http.Get(ep.URL)
+		go func(target monitoredEndpoint, channel chan bool) {
+			ep := target.endpoint
+			err := probeEndpoint(ep)
 			if err != nil {
-				// Timeout, DNS doesn't resolve, wrong protocol etc
-				log.Printf("Cannot do http GET against %s.\n", ep.URL)
-				channel <- false
-			} else {
-				if match, err := isMatchingResponse(ep, resp); !match {
-					log.Printf("Unexpected response when calling %s: %v.\n", ep.URL, err)
-					channel <- false
-				} else {
-					channel <- true
-				}
+				log.Printf("Unexpected response when calling %s: %v.\n", ep.URL, err)
 			}
-			defer resp.Body.Close()
-
+			timeline.recordProbe(target.ingress, ep, err == nil)
+			channel <- err == nil
 		}(endpoint, channel)
 	}
 
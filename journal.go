@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Label of every object created by kube-entropy, so leftovers can be cleaned up
+const managedLabel = "kube-entropy.io/managed"
+
+const (
+	undoNetworkPolicy = "networkpolicy"
+	undoScale         = "scale"
+	undoConfigMap     = "configmap"
+	undoTaint         = "taint"
+	undoCordon        = "cordon"
+	undoPod           = "pod"
+	// A pod template annotation, removed when the journal has no original value
+	undoTemplateAnnotation = "templateannotation"
+)
+
+// undoEntry describes how to revert a mutation which is still in effect
+type undoEntry struct {
+	ID        int               `yaml:"id"`
+	Time      time.Time         `yaml:"time"`
+	Kind      string            `yaml:"kind"`
+	Namespace string            `yaml:"namespace"`
+	Name      string            `yaml:"name"`
+	Data      map[string]string `yaml:"data"`
+}
+
+// undoJournal is saved to a file on every change, so the mutations can be reverted after a crash
+type undoJournal struct {
+	lock     sync.Mutex
+	fileName string
+	NextID   int         `yaml:"nextId"`
+	Entries  []undoEntry `yaml:"entries"`
+}
+
+var journal = undoJournal{NextID: 1}
+
+func loadJournal(fileName string) (err error) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	journal.fileName = fileName
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = yaml.Unmarshal(data, &journal)
+	if journal.NextID < 1 {
+		journal.NextID = 1
+	}
+	return err
+}
+
+func (j *undoJournal) save() {
+	if j.fileName == "" {
+		return
+	}
+	data, err := yaml.Marshal(j)
+	if err == nil {
+		err = ioutil.WriteFile(j.fileName, data, 0644)
+	}
+	if err != nil {
+		log.Printf("ERROR: Cannot save the undo journal %s: %v\n", j.fileName, err)
+	}
+}
+
+func (j *undoJournal) record(kind string, namespace string, name string, data map[string]string) (id int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	id = j.NextID
+	j.NextID++
+	j.Entries = append(j.Entries, undoEntry{ID: id, Time: time.Now(), Kind: kind, Namespace: namespace, Name: name, Data: data})
+	j.save()
+	return id
+}
+
+// complete forgets an entry once its mutation has been reverted
+func (j *undoJournal) complete(id int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for i, entry := range j.Entries {
+		if entry.ID == id {
+			j.Entries = append(j.Entries[:i], j.Entries[i+1:]...)
+			j.save()
+			return
+		}
+	}
+}
+
+func (j *undoJournal) pending() (entries []undoEntry) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return append(entries, j.Entries...)
+}
+
+func undo(ctx context.Context, clientset *kubernetes.Clientset, entry undoEntry) (err error) {
+	switch entry.Kind {
+	case undoNetworkPolicy:
+		err = clientset.NetworkingV1().NetworkPolicies(entry.Namespace).Delete(ctx, entry.Name, metav1.DeleteOptions{})
+	case undoScale:
+		replicas, convErr := strconv.Atoi(entry.Data["replicas"])
+		if convErr != nil {
+			return fmt.Errorf("invalid replica count %s: %v", entry.Data["replicas"], convErr)
+		}
+		err = scaleWorkload(ctx, clientset, entry.Namespace, entry.Data["kind"], entry.Name, replicas)
+	case undoTemplateAnnotation:
+		var value *string
+		if original, found := entry.Data["value"]; found {
+			value = &original
+		}
+		err = patchTemplateAnnotation(ctx, clientset, entry.Namespace, entry.Data["kind"], entry.Name, entry.Data["annotation"], value)
+	case undoPod:
+		err = clientset.CoreV1().Pods(entry.Namespace).Delete(ctx, entry.Name, *metav1.NewDeleteOptions(0))
+	case undoCordon:
+		err = setNodeUnschedulable(ctx, clientset, entry.Name, false)
+	case undoTaint:
+		err = removeNodeTaint(ctx, clientset, entry.Name, entry.Data["key"], entry.Data["effect"])
+	case undoConfigMap:
+		err = patchConfigMapKey(ctx, clientset, entry.Namespace, entry.Name, entry.Data["key"], entry.Data["value"])
+	default:
+		return fmt.Errorf("unknown undo entry kind %s", entry.Kind)
+	}
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// restoreJournaled reverts a journaled mutation once the disruption is over
+func restoreJournaled(ctx context.Context, clientset *kubernetes.Clientset, id int, entry undoEntry) {
+	log.Printf("Restoring %s %s.%s\n", entry.Kind, entry.Namespace, entry.Name)
+	err := undo(ctx, clientset, entry)
+	if err != nil {
+		log.Printf("ERROR: Cannot restore %s %s.%s: %v\n", entry.Kind, entry.Namespace, entry.Name, err)
+		return
+	}
+	journal.complete(id)
+}
+
+func patchConfigMapKey(ctx context.Context, clientset *kubernetes.Clientset, namespace string, name string, key string, value string) (err error) {
+	patch, err := json.Marshal(map[string]map[string]string{"data": {key: value}})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// undoAll reverts every mutation still recorded in the journal, newest first
+func undoAll(ctx context.Context, clientset *kubernetes.Clientset) {
+	entries := journal.pending()
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		log.Printf("Undoing %s %s.%s\n", entry.Kind, entry.Namespace, entry.Name)
+		err := undo(ctx, clientset, entry)
+		if err != nil {
+			log.Printf("ERROR: Cannot undo %s %s.%s: %v\n", entry.Kind, entry.Namespace, entry.Name, err)
+			continue
+		}
+		journal.complete(entry.ID)
+	}
+}
+
+// cleanupLeftovers deletes the objects created by kube-entropy which are not in the journal anymore
+func cleanupLeftovers(ctx context.Context, clientset *kubernetes.Clientset) {
+	listOptions := metav1.ListOptions{LabelSelector: managedLabel + "=true"}
+	policies, err := clientset.NetworkingV1().NetworkPolicies("").List(ctx, listOptions)
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of network policies: %v\n", err)
+	} else {
+		for _, policy := range policies.Items {
+			log.Printf("Deleting leftover network policy %s.%s\n", policy.Namespace, policy.Name)
+			err = clientset.NetworkingV1().NetworkPolicies(policy.Namespace).Delete(ctx, policy.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				log.Printf("ERROR: Cannot delete network policy %s.%s: %v\n", policy.Namespace, policy.Name, err)
+			}
+		}
+	}
+	pods, err := clientset.CoreV1().Pods("").List(ctx, listOptions)
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of pods: %v\n", err)
+	} else {
+		for _, pod := range pods.Items {
+			log.Printf("Deleting leftover pod %s.%s\n", pod.Namespace, pod.Name)
+			err = clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, *metav1.NewDeleteOptions(0))
+			if err != nil && !errors.IsNotFound(err) {
+				log.Printf("ERROR: Cannot delete pod %s.%s: %v\n", pod.Namespace, pod.Name, err)
+			}
+		}
+	}
+}
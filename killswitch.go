@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Value of the kill switch key or annotation which pauses all disruptions
+const pausedState = "paused"
+
+// Namespace of the service account, when running in a pod
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+type KillSwitchConfiguration struct {
+	Enabled    bool          `yaml:"enabled"`
+	Interval   time.Duration `yaml:"interval"`
+	Namespace  string        `yaml:"namespace"`
+	ConfigMap  string        `yaml:"configMap"`
+	Key        string        `yaml:"key"`
+	Annotation string        `yaml:"annotation"`
+}
+
+func withKillSwitchDefaults(switchConfig KillSwitchConfiguration) KillSwitchConfiguration {
+	if switchConfig.Interval <= 0 {
+		switchConfig.Interval = 2 * time.Second
+	}
+	if switchConfig.Namespace == "" {
+		switchConfig.Namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if switchConfig.Namespace == "" {
+		if data, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+			switchConfig.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if switchConfig.Namespace == "" {
+		switchConfig.Namespace = "default"
+	}
+	if switchConfig.ConfigMap == "" {
+		switchConfig.ConfigMap = "kube-entropy-control"
+	}
+	if switchConfig.Key == "" {
+		switchConfig.Key = "state"
+	}
+	if switchConfig.Annotation == "" {
+		switchConfig.Annotation = "kube-entropy.io/state"
+	}
+	return switchConfig
+}
+
+// Sources of a pause, the run is paused while any of them is
+const (
+	pauseSourceKillSwitch = "killswitch"
+	pauseSourceAPI        = "api"
+)
+
+// pauseSwitch is flipped by the kill switch watcher or the control API and checked by every disruptor before it acts
+type pauseSwitch struct {
+	lock    sync.Mutex
+	sources map[string]bool
+}
+
+var killSwitch = pauseSwitch{sources: map[string]bool{}}
+
+func (s *pauseSwitch) isPaused() bool {
+	return len(s.activeSources()) > 0
+}
+
+func (s *pauseSwitch) activeSources() (sources []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for source, paused := range s.sources {
+		if paused {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// set pauses or resumes the run for one source, returning whether its state was changed
+func (s *pauseSwitch) set(source string, paused bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sources[source] == paused {
+		return false
+	}
+	s.sources[source] = paused
+	value := 0.0
+	for _, paused := range s.sources {
+		if paused {
+			value = 1
+		}
+	}
+	metrics.setGauge("kube_entropy_paused", "Whether all disruptions are paused by the kill switch or the control API.", nil, value)
+	return true
+}
+
+// sleepUnlessPaused holds a disruption for a duration, waking up as soon as the run is paused,
+// so the disruption is restored right away. It returns whether the whole duration passed.
+func sleepUnlessPaused(duration time.Duration) bool {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		if killSwitch.isPaused() {
+			log.Printf("Kill switch: paused, restoring the disruption early.\n")
+			return false
+		}
+		step := time.Until(deadline)
+		if step > time.Second {
+			step = time.Second
+		}
+		time.Sleep(step)
+	}
+	return true
+}
+
+// pausedBy returns where the pause is requested, either the ConfigMap key or the namespace annotation
+func pausedBy(switchConfig KillSwitchConfiguration, data map[string]string, annotations map[string]string) string {
+	if strings.EqualFold(strings.TrimSpace(data[switchConfig.Key]), pausedState) {
+		return "configmap " + switchConfig.Namespace + "." + switchConfig.ConfigMap
+	}
+	if strings.EqualFold(strings.TrimSpace(annotations[switchConfig.Annotation]), pausedState) {
+		return "namespace " + switchConfig.Namespace
+	}
+	return ""
+}
+
+func checkKillSwitch(ctx context.Context, clientset *kubernetes.Clientset, switchConfig KillSwitchConfiguration) {
+	data := map[string]string{}
+	configMap, err := clientset.CoreV1().ConfigMaps(switchConfig.Namespace).Get(ctx, switchConfig.ConfigMap, metav1.GetOptions{})
+	if err == nil {
+		data = configMap.Data
+	} else if !errors.IsNotFound(err) {
+		log.Printf("ERROR: Cannot get the kill switch configmap %s.%s: %v\n", switchConfig.Namespace, switchConfig.ConfigMap, err)
+		return
+	}
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, switchConfig.Namespace, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot get the kill switch namespace %s: %v\n", switchConfig.Namespace, err)
+		return
+	}
+
+	source := pausedBy(switchConfig, data, namespace.Annotations)
+	if killSwitch.set(pauseSourceKillSwitch, source != "") {
+		if source != "" {
+			log.Printf("Kill switch: paused by %s, stopping all disruptions and restoring.\n", source)
+			metrics.addCounter("kube_entropy_pauses_total", "Number of times the disruptions were paused.", nil, 1)
+		} else {
+			log.Printf("Kill switch: cleared, disruptions continue unless paused otherwise.\n")
+		}
+	}
+	// Disruptions which were already under way when the pause came are reverted as soon as they are journaled
+	if killSwitch.isPaused() && len(journal.pending()) > 0 {
+		undoAll(ctx, clientset)
+	}
+}
+
+func watchKillSwitch(ctx context.Context, clientset *kubernetes.Clientset, switchConfig KillSwitchConfiguration) {
+
+	for true {
+		time.Sleep(switchConfig.Interval)
+		checkKillSwitch(ctx, clientset, switchConfig)
+	}
+}
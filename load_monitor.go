@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LoadConfiguration struct {
+	Enabled           bool          `yaml:"enabled"`
+	RPS               int           `yaml:"rps"`
+	Concurrency       int           `yaml:"concurrency"`
+	Timeout           time.Duration `yaml:"timeout"`
+	DisableKeepAlives bool          `yaml:"disableKeepAlives"`
+}
+
+// loadSecond aggregates the requests sent to an endpoint within a second
+type loadSecond struct {
+	Time      time.Time
+	Requests  int
+	Successes int
+	Errors    map[string]int
+	Latencies []time.Duration
+}
+
+func (second loadSecond) successRatio() float64 {
+	if second.Requests == 0 {
+		return 1
+	}
+	return float64(second.Successes) / float64(second.Requests)
+}
+
+func (second loadSecond) percentile(p float64) time.Duration {
+	if len(second.Latencies) == 0 {
+		return 0
+	}
+	latencies := make([]time.Duration, len(second.Latencies))
+	copy(latencies, second.Latencies)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	index := int(math.Ceil(p*float64(len(latencies)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return latencies[index]
+}
+
+func (second loadSecond) describeErrors() string {
+	categories := []string{}
+	for category, count := range second.Errors {
+		categories = append(categories, fmt.Sprintf("%s=%d", category, count))
+	}
+	sort.Strings(categories)
+	return strings.Join(categories, " ")
+}
+
+type endpointLoad struct {
+	lock    sync.Mutex
+	target  monitoredEndpoint
+	current loadSecond
+	total   loadSecond
+	worst   loadSecond
+}
+
+var loadResults = map[string]*endpointLoad{}
+var loadResultsLock sync.Mutex
+
+// categorizeResponse checks a response against the test plan, returning an error category or an empty string
+func categorizeResponse(endpoint EndpointState, resp *http.Response, err error) (category string) {
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	}
+	if resp.StatusCode != endpoint.Code {
+		return fmt.Sprintf("http_%d", resp.StatusCode)
+	}
+	if match, _ := isMatchingResponse(endpoint, resp); !match {
+		return "headers"
+	}
+	return ""
+}
+
+func (load *endpointLoad) record(latency time.Duration, category string) {
+	load.lock.Lock()
+	defer load.lock.Unlock()
+	load.current.Requests++
+	if category == "" {
+		load.current.Successes++
+		load.current.Latencies = append(load.current.Latencies, latency)
+	} else {
+		load.current.Errors[category]++
+	}
+}
+
+// flush closes the current second, logging and exposing its statistics
+func (load *endpointLoad) flush() {
+	load.lock.Lock()
+	second := load.current
+	load.current = loadSecond{Time: time.Now(), Errors: map[string]int{}}
+	load.total.Requests += second.Requests
+	load.total.Successes += second.Successes
+	for category, count := range second.Errors {
+		load.total.Errors[category] += count
+	}
+	if second.Requests > 0 && (load.worst.Requests == 0 || second.successRatio() < load.worst.successRatio()) {
+		load.worst = second
+	}
+	load.lock.Unlock()
+
+	url := load.target.endpoint.URL
+	if len(second.Errors) > 0 {
+		log.Printf("Load on %s: %d requests, %.1f%% success, p50 %s, p90 %s, p99 %s, errors: %s\n", url, second.Requests, 100*second.successRatio(),
+			second.percentile(0.5), second.percentile(0.9), second.percentile(0.99), second.describeErrors())
+	}
+
+	labels := map[string]string{"ingress": load.target.ingress.Namespace + "." + load.target.ingress.Name, "url": url}
+	metrics.setGauge("kube_entropy_load_success_ratio", "Ratio of successful load requests to an endpoint within the last second.", labels, second.successRatio())
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		quantileLabels := map[string]string{"quantile": fmt.Sprintf("%g", p)}
+		for key, value := range labels {
+			quantileLabels[key] = value
+		}
+		metrics.setGauge("kube_entropy_load_latency_seconds", "Latency percentiles of successful load requests to an endpoint within the last second.", quantileLabels, second.percentile(p).Seconds())
+	}
+	metrics.addCounter("kube_entropy_load_requests_total", "Load requests sent to an endpoint.", labels, float64(second.Requests))
+	for category, count := range second.Errors {
+		errorLabels := map[string]string{"category": category}
+		for key, value := range labels {
+			errorLabels[key] = value
+		}
+		metrics.addCounter("kube_entropy_load_errors_total", "Failed load requests to an endpoint by error category.", errorLabels, float64(count))
+	}
+}
+
+func newLoadClient(config LoadConfiguration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = config.Concurrency
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	return &http.Client{Transport: transport, Timeout: config.Timeout}
+}
+
+// generateLoad sends requests to an endpoint at a fixed rate with a pool of workers.
+// Requests which cannot be sent because all workers are busy are counted as saturated.
+func generateLoad(config LoadConfiguration, load *endpointLoad) {
+	client := newLoadClient(config)
+	requests := make(chan time.Time, config.Concurrency)
+	for i := 0; i < config.Concurrency; i++ {
+		go func() {
+			for range requests {
+				start := time.Now()
+				resp, err := client.Get(load.target.endpoint.URL)
+				category := categorizeResponse(load.target.endpoint, resp, err)
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				load.record(time.Since(start), category)
+				timeline.recordProbe(load.target.ingress, load.target.endpoint, category == "")
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(config.RPS))
+	for tick := range ticker.C {
+		select {
+		case requests <- tick:
+		default:
+			load.record(0, "saturated")
+		}
+	}
+}
+
+func withLoadDefaults(config LoadConfiguration) LoadConfiguration {
+	if config.RPS <= 0 {
+		config.RPS = 10
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 4
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	return config
+}
+
+// monitorIngressesUnderLoad replaces the periodic probes with a constant request rate on every endpoint
+func monitorIngressesUnderLoad(testPlan ApplicationState) {
+	config := withLoadDefaults(testPlan.Monitoring.Load)
+	loads := []*endpointLoad{}
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		for _, endpoint := range ingress.Endpoints {
+			load := &endpointLoad{
+				target:  monitoredEndpoint{ingress: ingress, endpoint: endpoint},
+				current: loadSecond{Time: time.Now(), Errors: map[string]int{}},
+				total:   loadSecond{Errors: map[string]int{}},
+			}
+			loadResultsLock.Lock()
+			loadResults[endpoint.URL] = load
+			loadResultsLock.Unlock()
+			loads = append(loads, load)
+			go generateLoad(config, load)
+		}
+	}
+
+	for true {
+		time.Sleep(time.Second)
+		for _, load := range loads {
+			load.flush()
+		}
+	}
+}
+
+func printLoadReport(out io.Writer) {
+	loadResultsLock.Lock()
+	defer loadResultsLock.Unlock()
+	if len(loadResults) == 0 {
+		return
+	}
+
+	urls := []string{}
+	for url := range loadResults {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	fmt.Fprintf(out, "Load report\n")
+	for _, url := range urls {
+		load := loadResults[url]
+		load.lock.Lock()
+		fmt.Fprintf(out, "%s: %d requests, %.2f%% success", url, load.total.Requests, 100*load.total.successRatio())
+		if load.worst.Requests > 0 {
+			fmt.Fprintf(out, ", worst second %.1f%% at %s", 100*load.worst.successRatio(), load.worst.Time.Format(time.RFC3339))
+		}
+		fmt.Fprintf(out, ", errors: %s\n", load.total.describeErrors())
+		load.lock.Unlock()
+	}
+}
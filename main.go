@@ -10,10 +10,13 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -25,6 +28,10 @@ import (
 var dc discoveryConfig
 var inCluster bool
 
+// Image tag of this build, set with -ldflags "-X main.version=<tag>"
+var version = "latest"
+var restConfig *rest.Config
+
 func betterPanic(message string, args ...string) {
 	temp := fmt.Sprintf(message, args)
 	fmt.Printf("%s\n\n", temp)
@@ -73,9 +80,68 @@ func main() {
 	testPlanFileName := flag.String("config", "./testplan.yaml", "Test plan file")
 	discoveryConfigFileName := flag.String("dc", "./config/discovery.yaml", "Discovery file for the kube-entropy")
 
-	mode := flag.String("mode", "chaos", "Runtime mode: chaos (default), discovery")
+	mode := flag.String("mode", "chaos", "Runtime mode: chaos (default), discovery, dryrun, restore, topology, proxy, stress")
+	format := flag.String("format", "tree", "Topology output format: tree (default), dot")
+	listen := flag.String("listen", ":8080", "Address to serve metrics and the control API on")
+	journalFileName := flag.String("journal", "./undo-journal.yaml", "Undo journal file, used to revert disruptions after a crash")
+	stressCPU := flag.Int("stress-cpu", 0, "Stress mode: number of CPUs to keep busy")
+	stressMemory := flag.String("stress-memory", "", "Stress mode: memory to allocate, e.g. 256Mi")
+	stressDisk := flag.String("stress-disk", "", "Stress mode: disk space to fill, e.g. 1Gi")
+	stressDuration := flag.Duration("stress-duration", time.Minute, "Stress mode: how long to stress")
+	stressDir := flag.String("stress-dir", os.TempDir(), "Stress mode: directory to fill")
 	flag.Parse()
 
+	if *mode == "stress" {
+		load := stressLoad{CPU: *stressCPU, Duration: *stressDuration, Dir: *stressDir}
+		for _, quantity := range []struct {
+			value  string
+			target *int64
+		}{{*stressMemory, &load.Memory}, {*stressDisk, &load.Disk}} {
+			if quantity.value != "" {
+				parsed, err := resource.ParseQuantity(quantity.value)
+				if err != nil {
+					betterPanic(err.Error())
+				}
+				*quantity.target = parsed.Value()
+			}
+		}
+		err := runStress(load)
+		if err != nil {
+			betterPanic(err.Error())
+		}
+		return
+	}
+
+	if *mode == "topology" {
+		testPlan, err := readTestPlan(*testPlanFileName)
+		if err != nil {
+			betterPanic(err.Error())
+		}
+		if *format == "dot" {
+			printTopologyDot(testPlan, os.Stdout)
+		} else {
+			printTopologyTree(testPlan, os.Stdout)
+		}
+		return
+	}
+
+	if *mode == "proxy" {
+		testPlan, err := readTestPlan(*testPlanFileName)
+		if err != nil {
+			betterPanic(err.Error())
+		}
+		rand.Seed(time.Now().UnixNano())
+		go serveMetrics(*listen)
+		startFaultProxies(testPlan)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Printf("Stopping the fault proxies.\n")
+		timeline.printReport(os.Stdout)
+		return
+	}
+
 	var kubeconfig *string
 	home := homeDir()
 	if home != "" {
@@ -95,6 +161,7 @@ func main() {
 		inCluster = true
 	}
 	inCluster = false
+	restConfig = config
 
 	if inCluster {
 		log.Printf("Configured to run in in-cluster mode.\n")
@@ -124,15 +191,79 @@ func main() {
 				betterPanic(err.Error())
 			}
 
+			err = validateSchedule(testPlan.Schedule)
+			if err != nil {
+				betterPanic(err.Error())
+			}
+
+			err = validateTerminations(testPlan.Disruption.Pods)
+			if err != nil {
+				betterPanic(err.Error())
+			}
+
+			timeline.attributionWindow = withRecoveryDefaults(testPlan.Monitoring.Recovery).Timeout
+
+			err = startWebhooks(testPlan.Webhooks)
+			if err != nil {
+				betterPanic(err.Error())
+			}
+
+			err = loadJournal(*journalFileName)
+			if err != nil {
+				betterPanic(err.Error())
+			}
+			if len(journal.pending()) > 0 {
+				log.Printf("Reverting disruptions left over by a previous run.\n")
+				undoAll(ctx, clientset)
+			}
+
+			if testPlan.API.Enabled {
+				log.Printf("Serving the control API on %s.\n", *listen)
+				startControlAPI(ctx, testPlan, clientset)
+			}
+			go serveMetrics(*listen)
+
+			if testPlan.KillSwitch.Enabled {
+				switchConfig := withKillSwitchDefaults(testPlan.KillSwitch)
+				log.Printf("Watching the kill switch in configmap %s.%s and namespace %s.\n", switchConfig.Namespace, switchConfig.ConfigMap, switchConfig.Namespace)
+				metrics.setGauge("kube_entropy_paused", "Whether all disruptions are paused by the kill switch or the control API.", nil, 0)
+				checkKillSwitch(ctx, clientset, switchConfig)
+				go watchKillSwitch(ctx, clientset, switchConfig)
+			}
+
 			log.Printf("Entropying it up.\n")
 			if testPlan.Disruption.Pods.Enabled {
 				log.Printf("Launching the pod killer.\n")
 				go killPods(ctx, testPlan, clientset)
 			}
-			if testPlan.Disruption.Nodes.Enabled {
+			if testPlan.Disruption.Nodes.Enabled && testPlan.Disruption.Nodes.Mode == nodeTaint {
+				log.Printf("Launching the node tainter.\n")
+				go taintNodes(ctx, testPlan, clientset)
+			} else if testPlan.Disruption.Nodes.Enabled {
 				log.Printf("Launching the node killer.\n")
 				go killNodes(ctx, testPlan, clientset)
 			}
+			if testPlan.Disruption.Workloads.Enabled {
+				log.Printf("Launching the workload disruptor.\n")
+				go disruptWorkloads(ctx, testPlan, clientset)
+			}
+			if testPlan.Disruption.Stress.Enabled {
+				log.Printf("Launching the node stressor.\n")
+				go stressNodes(ctx, testPlan, clientset)
+			}
+			if testPlan.Disruption.IngressController.Enabled {
+				log.Printf("Launching the ingress controller disruptor.\n")
+				go disruptIngressController(ctx, testPlan, clientset)
+			}
+			if testPlan.Disruption.Network.Enabled {
+				log.Printf("Launching the network partitioner.\n")
+				go partitionNetwork(ctx, testPlan, clientset)
+			}
+			if testPlan.Disruption.DNS.Enabled {
+				log.Printf("Launching the DNS disruptor.\n")
+				go disruptDNS(ctx, testPlan, clientset)
+			}
+			startFaultProxies(testPlan)
 
 			/*if inCluster {
 				if ec.MonitoringSettings.ServiceMonitoring.Selector.Enabled {
@@ -143,16 +274,40 @@ func main() {
 				}
 			}*/
 
-			if testPlan.Monitoring.Enabled {
+			if testPlan.Monitoring.Enabled && testPlan.Monitoring.Load.Enabled {
+				load := withLoadDefaults(testPlan.Monitoring.Load)
+				log.Printf("Launching the ingress monitor under load.\n")
+				log.Printf("Sending %d requests per second to every endpoint with %d workers.\n", load.RPS, load.Concurrency)
+
+				go monitorIngressesUnderLoad(testPlan)
+			} else if testPlan.Monitoring.Enabled {
 				log.Printf("Launching the ingress monitor.\n")
 				log.Printf("Monitoring ingresses every %s.\n", testPlan.Monitoring.Interval)
 
 				go monitorIngresses(testPlan)
 			}
+			if testPlan.Monitoring.Enabled {
+				go watchSteadyState(testPlan)
+			}
+			notify(eventRunStarted, "kube-entropy started a chaos run", map[string]string{})
 
-			for true {
-				time.Sleep(30 * time.Second)
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			select {
+			case <-signals:
+			case <-stopRun:
 			}
+
+			log.Printf("Stopping kube-entropy.\n")
+			undoAll(ctx, clientset)
+			timeline.printReport(os.Stdout)
+			printRecoveryReport(os.Stdout)
+			printLoadReport(os.Stdout)
+
+			disruptions, outages, unrecovered := timeline.summary()
+			notify(eventRunFinished, fmt.Sprintf("kube-entropy finished a chaos run: %d disruptions, %d outages, %d not recovered", disruptions, outages, unrecovered),
+				map[string]string{"disruptions": fmt.Sprint(disruptions), "outages": fmt.Sprint(outages), "unrecovered": fmt.Sprint(unrecovered)})
+			stopWebhooks(30 * time.Second)
 		} else if *mode == "discovery" {
 			log.Printf("Discovering the current configuration.\n")
 
@@ -166,6 +321,15 @@ func main() {
 			// Ingresses -- look at the http response codes
 			// Record to a config file
 			discover(ctx, dc, clientset)
+		} else if *mode == "restore" {
+			log.Printf("Reverting disruptions recorded in %s.\n", *journalFileName)
+
+			err = loadJournal(*journalFileName)
+			if err != nil {
+				betterPanic(err.Error())
+			}
+			undoAll(ctx, clientset)
+			cleanupLeftovers(ctx, clientset)
 		} else if *mode == "dryrun" {
 			// TODO: verify if test plan is still valid
 			// TODO: add a resilient service for testing
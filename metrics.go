@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricRegistry keeps the latest value of every metric and renders them in the Prometheus text format
+type metricRegistry struct {
+	lock   sync.Mutex
+	help   map[string]string
+	kinds  map[string]string
+	values map[string]map[string]float64
+}
+
+var metrics = metricRegistry{help: map[string]string{}, kinds: map[string]string{}, values: map[string]map[string]float64{}}
+
+func renderLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for name, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (registry *metricRegistry) series(name string, kind string, help string) map[string]float64 {
+	if _, found := registry.values[name]; !found {
+		registry.values[name] = map[string]float64{}
+		registry.help[name] = help
+		registry.kinds[name] = kind
+	}
+	return registry.values[name]
+}
+
+func (registry *metricRegistry) setGauge(name string, help string, labels map[string]string, value float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.series(name, "gauge", help)[renderLabels(labels)] = value
+}
+
+func (registry *metricRegistry) addCounter(name string, help string, labels map[string]string, delta float64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.series(name, "counter", help)[renderLabels(labels)] += delta
+}
+
+func (registry *metricRegistry) write(out io.Writer) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	names := []string{}
+	for name := range registry.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, registry.help[name], name, registry.kinds[name])
+		series := []string{}
+		for labels := range registry.values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			fmt.Fprintf(out, "%s%s %g\n", name, labels, registry.values[name][labels])
+		}
+	}
+}
+
+func serveMetrics(address string) {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+	log.Printf("Serving metrics on %s.\n", address)
+	err := http.ListenAndServe(address, nil)
+	if err != nil {
+		log.Printf("ERROR: Cannot serve metrics on %s: %v\n", address, err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	nodeSelectOne  = "one"
+	nodeSelectZone = "zone"
+)
+
+// listTargetNodes resolves the nodes which may be disrupted, by selectors when they are set,
+// by the node names recorded during the discovery otherwise
+func listTargetNodes(ctx context.Context, clientset *kubernetes.Clientset, nodeConfig NodeConfiguration) (nodes []v1.Node, err error) {
+	selected := len(nodeConfig.Fields) > 0 || len(nodeConfig.Labels) > 0
+	listOptions := metav1.ListOptions{}
+	if selected {
+		listOptions = listSelectors(entropySelector{Fields: nodeConfig.Fields, Labels: nodeConfig.Labels})
+	}
+	list, err := clientset.CoreV1().Nodes().List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range list.Items {
+		if selected || len(nodeConfig.Items) == 0 || containsString(nodeConfig.Items, node.Name) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// selectNodes picks the nodes to disrupt out of the eligible candidates, given the nodes already disrupted.
+// The zone selection takes out every candidate of a random zone, otherwise a single node is picked,
+// never exceeding maxPerZone disrupted nodes in a zone.
+func selectNodes(nodeConfig NodeConfiguration, candidates []v1.Node, disrupted []v1.Node) (victims []v1.Node) {
+	if nodeConfig.Selection == nodeSelectZone {
+		zones := []string{}
+		for _, node := range candidates {
+			if !containsString(zones, node.Labels[zoneLabel]) {
+				zones = append(zones, node.Labels[zoneLabel])
+			}
+		}
+		if len(zones) == 0 {
+			return nil
+		}
+		zone := zones[rand.Intn(len(zones))]
+		for _, node := range candidates {
+			if node.Labels[zoneLabel] == zone {
+				victims = append(victims, node)
+			}
+		}
+		return victims
+	}
+
+	perZone := map[string]int{}
+	for _, node := range disrupted {
+		perZone[node.Labels[zoneLabel]]++
+	}
+	eligible := []v1.Node{}
+	for _, node := range candidates {
+		if nodeConfig.MaxPerZone > 0 && perZone[node.Labels[zoneLabel]] >= nodeConfig.MaxPerZone {
+			continue
+		}
+		eligible = append(eligible, node)
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+	return []v1.Node{eligible[rand.Intn(len(eligible))]}
+}
+
+func podRequests(pod v1.Pod) (cpu int64, memory int64) {
+	for _, container := range pod.Spec.Containers {
+		cpu += container.Resources.Requests.Cpu().MilliValue()
+		memory += container.Resources.Requests.Memory().Value()
+	}
+	return cpu, memory
+}
+
+// capacityShortfall checks if the schedulable nodes left after disrupting the victims can still
+// accommodate the requests of the running pods, returning the reason when they can't
+func capacityShortfall(nodes []v1.Node, victims []v1.Node, pods []v1.Pod) (reason string) {
+	victimNames := []string{}
+	for _, node := range victims {
+		victimNames = append(victimNames, node.Name)
+	}
+	var allocatableCPU, allocatableMemory int64
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || containsString(victimNames, node.Name) {
+			continue
+		}
+		allocatableCPU += node.Status.Allocatable.Cpu().MilliValue()
+		allocatableMemory += node.Status.Allocatable.Memory().Value()
+	}
+	var requestedCPU, requestedMemory int64
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		cpu, memory := podRequests(pod)
+		requestedCPU += cpu
+		requestedMemory += memory
+	}
+	if requestedCPU > allocatableCPU {
+		return fmt.Sprintf("pods request %dm CPU, only %dm would remain allocatable", requestedCPU, allocatableCPU)
+	}
+	if requestedMemory > allocatableMemory {
+		return fmt.Sprintf("pods request %d bytes of memory, only %d would remain allocatable", requestedMemory, allocatableMemory)
+	}
+	return ""
+}
+
+func checkNodeCapacity(ctx context.Context, clientset *kubernetes.Clientset, victims []v1.Node) (allowed bool) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of nodes to check the capacity: %v\n", err)
+		return false
+	}
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of pods to check the capacity: %v\n", err)
+		return false
+	}
+	if reason := capacityShortfall(nodes.Items, victims, pods.Items); reason != "" {
+		log.Printf("Capacity guard: refusing to disrupt %d nodes, %s.\n", len(victims), reason)
+		return false
+	}
+	return true
+}
+
+// nodeProblem describes why a node is unhealthy, or returns an empty string for a healthy node
+func nodeProblem(node v1.Node) string {
+	ready := false
+	for _, condition := range node.Status.Conditions {
+		switch condition.Type {
+		case v1.NodeReady:
+			ready = condition.Status == v1.ConditionTrue
+		case v1.NodeMemoryPressure, v1.NodeDiskPressure, v1.NodePIDPressure:
+			if condition.Status == v1.ConditionTrue {
+				return fmt.Sprintf("node %s is under %s", node.Name, condition.Type)
+			}
+		}
+	}
+	if !ready {
+		return fmt.Sprintf("node %s is NotReady", node.Name)
+	}
+	return ""
+}
+
+// clusterProblem gates a round of node disruption on the health of the target nodes
+func clusterProblem(nodeConfig NodeConfiguration, nodes []v1.Node, pendingPods int) string {
+	readyNodes := 0
+	for _, node := range nodes {
+		if problem := nodeProblem(node); problem != "" {
+			return problem
+		}
+		if !node.Spec.Unschedulable {
+			readyNodes++
+		}
+	}
+	if readyNodes < nodeConfig.MinReadyNodes {
+		return fmt.Sprintf("only %d Ready schedulable nodes, minimum is %d", readyNodes, nodeConfig.MinReadyNodes)
+	}
+	if nodeConfig.MaxPendingPods > 0 && pendingPods > nodeConfig.MaxPendingPods {
+		return fmt.Sprintf("%d pods are Pending, maximum is %d", pendingPods, nodeConfig.MaxPendingPods)
+	}
+	return ""
+}
+
+func countPendingPods(ctx context.Context, clientset *kubernetes.Clientset) (pending int, err error) {
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "status.phase=Pending"})
+	if err != nil {
+		return 0, err
+	}
+	return len(pods.Items), nil
+}
+
+// chooseNodes resolves the target nodes and picks the ones to disrupt, applying the guardrails,
+// the zone limits and the capacity guard. disrupted tells apart the nodes which are already disrupted.
+func chooseNodes(ctx context.Context, testPlan ApplicationState, clientset *kubernetes.Clientset, nodeConfig NodeConfiguration, disrupted func(node v1.Node) bool) (victims []v1.Node) {
+	// The node set is resolved on every round, so added and removed nodes are noticed
+	nodes, err := listTargetNodes(ctx, clientset, nodeConfig)
+	if err != nil {
+		log.Printf("ERROR: Cannot get a list of nodes. Skipping for now: %v\n", err)
+		return nil
+	}
+	log.Printf("%d nodes found\n", len(nodes))
+
+	pendingPods := 0
+	if nodeConfig.MaxPendingPods > 0 {
+		pendingPods, err = countPendingPods(ctx, clientset)
+		if err != nil {
+			log.Printf("ERROR: Cannot get a list of pending pods. Skipping for now: %v\n", err)
+			return nil
+		}
+	}
+	if problem := clusterProblem(nodeConfig, nodes, pendingPods); problem != "" {
+		log.Printf("Health gate: skipping node disruption, %s.\n", problem)
+		return nil
+	}
+
+	unavailable := []v1.Node{}
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || disrupted(node) {
+			unavailable = append(unavailable, node)
+		}
+	}
+	available := len(nodes) - len(unavailable)
+	if available <= 1 {
+		log.Println("ERROR: Only 1 schedulable node found, cannot disrupt it.")
+		return nil
+	}
+
+	candidates := []v1.Node{}
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || disrupted(node) {
+			continue
+		}
+		allowed, overrides := checkGuardrails(ctx, clientset, testPlan.Safety, "node", &node)
+		if allowed && checkOverrides(overrides, "node", node.Name, "node/"+node.Name, len(unavailable)) {
+			candidates = append(candidates, node)
+		}
+	}
+
+	victims = selectNodes(nodeConfig, candidates, unavailable)
+	if len(victims) == 0 {
+		log.Println("No nodes eligible for disruption.")
+		return nil
+	}
+	if len(victims) >= available {
+		log.Printf("ERROR: Disrupting %d nodes would leave no schedulable node.\n", len(victims))
+		return nil
+	}
+	if nodeConfig.CapacityGuard && !checkNodeCapacity(ctx, clientset, victims) {
+		return nil
+	}
+	return victims
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RecoveryConfiguration struct {
+	Enabled       bool          `yaml:"enabled"`
+	Interval      time.Duration `yaml:"interval"`
+	FailureWindow time.Duration `yaml:"failureWindow"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+type recoveryMeasurement struct {
+	Ingress            string
+	URL                string
+	DisruptionID       int
+	Impacted           bool
+	Recovered          bool
+	TimeToFirstFailure time.Duration
+	Outage             time.Duration
+	FailedRequests     int
+}
+
+type ingressRecovery struct {
+	Disruptions    int
+	Outages        int
+	Unrecovered    int
+	FailedRequests int
+	TotalOutage    time.Duration
+	TotalTTFF      time.Duration
+}
+
+func (recovery ingressRecovery) mttr() time.Duration {
+	if recovery.Outages == recovery.Unrecovered {
+		return 0
+	}
+	return recovery.TotalOutage / time.Duration(recovery.Outages-recovery.Unrecovered)
+}
+
+var recoveryStats = map[string]*ingressRecovery{}
+var recoveryStatsLock sync.Mutex
+
+func withRecoveryDefaults(config RecoveryConfiguration) RecoveryConfiguration {
+	if config.Interval <= 0 {
+		config.Interval = 250 * time.Millisecond
+	}
+	if config.FailureWindow <= 0 {
+		config.FailureWindow = 30 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Minute
+	}
+	return config
+}
+
+// reportDisruption adds a disruption to the timeline and measures the recovery of the endpoints it touches
+func reportDisruption(testPlan ApplicationState, disruption disruptionEvent) {
+	disruption = timeline.recordDisruption(disruption)
+	notifyDisruption(disruption)
+	if !testPlan.Monitoring.Recovery.Enabled {
+		return
+	}
+	config := withRecoveryDefaults(testPlan.Monitoring.Recovery)
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		for _, endpoint := range ingress.Endpoints {
+			if disruption.touches(endpoint) {
+				go func(target monitoredEndpoint) {
+					recordRecovery(measureRecovery(config, disruption, target))
+				}(monitoredEndpoint{ingress: ingress, endpoint: endpoint})
+			}
+		}
+	}
+}
+
+// measureRecovery probes an endpoint at a high frequency after a disruption, until it recovers.
+// An endpoint which doesn't fail within the failure window is considered not impacted.
+func measureRecovery(config RecoveryConfiguration, disruption disruptionEvent, target monitoredEndpoint) (measurement recoveryMeasurement) {
+	measurement = recoveryMeasurement{Ingress: target.ingress.Namespace + "." + target.ingress.Name, URL: target.endpoint.URL, DisruptionID: disruption.ID}
+	var firstFailure time.Time
+	deadline := disruption.Time.Add(config.Timeout)
+	for time.Now().Before(deadline) {
+		err := probeEndpoint(target.endpoint)
+		timeline.recordProbe(target.ingress, target.endpoint, err == nil)
+		now := time.Now()
+		if err != nil {
+			if firstFailure.IsZero() {
+				firstFailure = now
+				measurement.Impacted = true
+				measurement.TimeToFirstFailure = now.Sub(disruption.Time)
+			}
+			measurement.FailedRequests++
+		} else if measurement.Impacted {
+			measurement.Recovered = true
+			measurement.Outage = now.Sub(firstFailure)
+			return measurement
+		} else if now.Sub(disruption.Time) > config.FailureWindow {
+			measurement.Recovered = true
+			return measurement
+		}
+		time.Sleep(config.Interval)
+	}
+	if measurement.Impacted {
+		measurement.Outage = time.Since(firstFailure)
+	}
+	return measurement
+}
+
+func recordRecovery(measurement recoveryMeasurement) {
+	if measurement.Impacted {
+		log.Printf("%s failed %s after disruption #%d, outage of %s with %d failed requests, recovered: %t\n", measurement.URL,
+			measurement.TimeToFirstFailure.Round(time.Millisecond), measurement.DisruptionID, measurement.Outage.Round(time.Millisecond), measurement.FailedRequests, measurement.Recovered)
+	}
+
+	recoveryStatsLock.Lock()
+	defer recoveryStatsLock.Unlock()
+	recovery, found := recoveryStats[measurement.Ingress]
+	if !found {
+		recovery = &ingressRecovery{}
+		recoveryStats[measurement.Ingress] = recovery
+	}
+	recovery.Disruptions++
+	if measurement.Impacted {
+		recovery.Outages++
+		recovery.FailedRequests += measurement.FailedRequests
+		recovery.TotalTTFF += measurement.TimeToFirstFailure
+		if measurement.Recovered {
+			recovery.TotalOutage += measurement.Outage
+		} else {
+			recovery.Unrecovered++
+		}
+	}
+
+	labels := map[string]string{"ingress": measurement.Ingress}
+	metrics.setGauge("kube_entropy_mttr_seconds", "Mean time to recovery of an ingress after a disruption.", labels, recovery.mttr().Seconds())
+	metrics.setGauge("kube_entropy_disruptions_measured", "Disruptions after which the recovery of an ingress was measured.", labels, float64(recovery.Disruptions))
+	metrics.setGauge("kube_entropy_outages", "Disruptions which caused an outage of an ingress.", labels, float64(recovery.Outages))
+	metrics.setGauge("kube_entropy_unrecovered_outages", "Outages of an ingress which didn't recover in time.", labels, float64(recovery.Unrecovered))
+	metrics.setGauge("kube_entropy_outage_failed_requests", "Requests to an ingress which failed during outages.", labels, float64(recovery.FailedRequests))
+	metrics.setGauge("kube_entropy_last_outage_seconds", "Duration of the last outage of an ingress endpoint.", map[string]string{"ingress": measurement.Ingress, "url": measurement.URL}, measurement.Outage.Seconds())
+	metrics.setGauge("kube_entropy_last_time_to_first_failure_seconds", "Time between the last disruption and the first failure of an ingress endpoint.", map[string]string{"ingress": measurement.Ingress, "url": measurement.URL}, measurement.TimeToFirstFailure.Seconds())
+}
+
+func printRecoveryReport(out io.Writer) {
+	recoveryStatsLock.Lock()
+	defer recoveryStatsLock.Unlock()
+
+	ingresses := []string{}
+	for ingress := range recoveryStats {
+		ingresses = append(ingresses, ingress)
+	}
+	sort.Strings(ingresses)
+
+	fmt.Fprintf(out, "Recovery report\n")
+	for _, ingress := range ingresses {
+		recovery := recoveryStats[ingress]
+		meanTTFF := time.Duration(0)
+		if recovery.Outages > 0 {
+			meanTTFF = recovery.TotalTTFF / time.Duration(recovery.Outages)
+		}
+		fmt.Fprintf(out, "%s: %d disruptions, %d outages (%d unrecovered), MTTR %s, mean time to first failure %s, %d failed requests\n", ingress,
+			recovery.Disruptions, recovery.Outages, recovery.Unrecovered, recovery.mttr().Round(time.Millisecond), meanTTFF.Round(time.Millisecond), recovery.FailedRequests)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Time zones are embedded, the container image has no zoneinfo
+	_ "time/tzdata"
+)
+
+// ScheduleWindow allows disruptions either for a duration after every match of a cron expression,
+// or between two times of the day on the listed weekdays
+type ScheduleWindow struct {
+	Cron     string        `yaml:"cron"`
+	Duration time.Duration `yaml:"duration"`
+	Weekdays []string      `yaml:"weekdays"`
+	From     string        `yaml:"from"`
+	To       string        `yaml:"to"`
+}
+
+type ScheduleConfiguration struct {
+	Enabled    bool             `yaml:"enabled"`
+	Timezone   string           `yaml:"timezone"`
+	Windows    []ScheduleWindow `yaml:"windows"`
+	Blackouts  []string         `yaml:"blackouts"`
+	MaxActions int              `yaml:"maxActions"`
+}
+
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays []bool
+	anyDay, anyWeekday                     bool
+}
+
+func parseCronField(field string, min int, max int) (values []bool, err error) {
+	values = make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %s", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid range %s", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%s is out of the range %d-%d", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+// parseCron parses a standard five field cron expression: minute, hour, day of month, month and day of week
+func parseCron(expression string) (schedule cronSchedule, err error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return schedule, fmt.Errorf("cron expression %q must have 5 fields", expression)
+	}
+	ranges := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	parsed := make([][]bool, 5)
+	for i, field := range fields {
+		parsed[i], err = parseCronField(field, ranges[i][0], ranges[i][1])
+		if err != nil {
+			return schedule, fmt.Errorf("cron expression %q: %v", expression, err)
+		}
+	}
+	schedule = cronSchedule{minutes: parsed[0], hours: parsed[1], days: parsed[2], months: parsed[3], weekdays: parsed[4]}
+	// Both 0 and 7 stand for Sunday
+	schedule.weekdays[0] = schedule.weekdays[0] || schedule.weekdays[7]
+	// A field covering its whole range, like * or */1, doesn't restrict the days
+	schedule.anyDay, schedule.anyWeekday = allSet(schedule.days[1:]), allSet(schedule.weekdays[:7])
+	return schedule, nil
+}
+
+func allSet(values []bool) bool {
+	for _, value := range values {
+		if !value {
+			return false
+		}
+	}
+	return true
+}
+
+func (schedule cronSchedule) matches(t time.Time) bool {
+	if !schedule.minutes[t.Minute()] || !schedule.hours[t.Hour()] || !schedule.months[int(t.Month())] {
+		return false
+	}
+	day, weekday := schedule.days[t.Day()], schedule.weekdays[int(t.Weekday())]
+	// Like cron, a restricted day of month and day of week match either of them
+	if !schedule.anyDay && !schedule.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+func parseTimeOfDay(value string, fallback time.Duration) (offset time.Duration, err error) {
+	if value == "" {
+		return fallback, nil
+	}
+	parts := strings.SplitN(value, ":", 2)
+	hours, err := strconv.Atoi(parts[0])
+	minutes := 0
+	if err == nil && len(parts) == 2 {
+		minutes, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time of day %s", value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// parseWeekday accepts a weekday name or its abbreviation of at least three letters, e.g. mon or Monday
+func parseWeekday(name string) (day time.Weekday, err error) {
+	for day = time.Sunday; day <= time.Saturday; day++ {
+		if len(name) >= 3 && strings.HasPrefix(strings.ToLower(day.String()), strings.ToLower(name)) {
+			return day, nil
+		}
+	}
+	return day, fmt.Errorf("invalid weekday %s", name)
+}
+
+func weekdayListed(weekdays []string, day time.Weekday) bool {
+	if len(weekdays) == 0 {
+		return true
+	}
+	for _, weekday := range weekdays {
+		if listed, err := parseWeekday(weekday); err == nil && listed == day {
+			return true
+		}
+	}
+	return false
+}
+
+// activeSince returns the start of the window occurrence containing a time, if there is one
+func (window ScheduleWindow) activeSince(now time.Time) (start time.Time, active bool, err error) {
+	if window.Cron != "" {
+		schedule, err := parseCron(window.Cron)
+		if err != nil {
+			return start, false, err
+		}
+		minute := now.Truncate(time.Minute)
+		for elapsed := time.Duration(0); elapsed <= window.Duration; elapsed += time.Minute {
+			if schedule.matches(minute.Add(-elapsed)) {
+				return minute.Add(-elapsed), true, nil
+			}
+		}
+		return start, false, nil
+	}
+
+	from, err := parseTimeOfDay(window.From, 0)
+	if err != nil {
+		return start, false, err
+	}
+	to, err := parseTimeOfDay(window.To, 24*time.Hour)
+	if err != nil {
+		return start, false, err
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// A window past midnight may have started the day before
+	for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+		// Bounds are wall clock times, so days with a daylight saving change don't shift them
+		year, month, date := day.Date()
+		start := time.Date(year, month, date, 0, int(from/time.Minute), 0, 0, now.Location())
+		end := time.Date(year, month, date, 0, int(to/time.Minute), 0, 0, now.Location())
+		if to <= from {
+			end = time.Date(year, month, date+1, 0, int(to/time.Minute), 0, 0, now.Location())
+		}
+		if weekdayListed(window.Weekdays, day.Weekday()) && !now.Before(start) && now.Before(end) {
+			return start, true, nil
+		}
+	}
+	return start, false, nil
+}
+
+// allowedWindow checks the schedule at a time, returning the start of the allowed window or the reason it isn't allowed
+func allowedWindow(config ScheduleConfiguration, now time.Time) (start time.Time, reason string) {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return start, err.Error()
+	}
+	now = now.In(location)
+	if containsString(config.Blackouts, now.Format("2006-01-02")) {
+		return start, "blackout date " + now.Format("2006-01-02")
+	}
+	if len(config.Windows) == 0 {
+		return start, ""
+	}
+	for _, window := range config.Windows {
+		start, active, err := window.activeSince(now)
+		if err != nil {
+			return start, err.Error()
+		}
+		if active {
+			return start, ""
+		}
+	}
+	return start, "outside of the schedule windows"
+}
+
+func validateSchedule(config ScheduleConfiguration) (err error) {
+	if _, err = time.LoadLocation(config.Timezone); err != nil {
+		return err
+	}
+	for _, blackout := range config.Blackouts {
+		if _, err = time.Parse("2006-01-02", blackout); err != nil {
+			return fmt.Errorf("invalid blackout date %s", blackout)
+		}
+	}
+	for _, window := range config.Windows {
+		if _, _, err = window.activeSince(time.Now()); err != nil {
+			return err
+		}
+		for _, weekday := range window.Weekdays {
+			if _, err = parseWeekday(weekday); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scheduleGate counts the actions of all disruptors in every window occurrence, by its start
+type scheduleGate struct {
+	lock    sync.Mutex
+	actions map[int64]int
+}
+
+var schedule = scheduleGate{actions: map[int64]int{}}
+
+func (gate *scheduleGate) acquire(config ScheduleConfiguration, now time.Time) (allowed bool, reason string) {
+	start, reason := allowedWindow(config, now)
+	if reason != "" {
+		return false, reason
+	}
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+	if config.MaxActions > 0 && len(config.Windows) > 0 && gate.actions[start.Unix()] >= config.MaxActions {
+		return false, fmt.Sprintf("%d actions already taken in the window since %s", gate.actions[start.Unix()], start.Format(time.RFC3339))
+	}
+	gate.actions[start.Unix()]++
+	return true, ""
+}
+
+// waitForSchedule blocks a disruptor while the kill switch is paused and until the schedule allows another action.
+// Monitoring isn't gated.
+func waitForSchedule(testPlan ApplicationState, disruptor string) {
+	waitForScheduleIdling(testPlan, disruptor, nil)
+}
+
+// waitForScheduleIdling is waitForSchedule running idle every time before it sleeps, e.g. to lift what a triggered action left behind
+func waitForScheduleIdling(testPlan ApplicationState, disruptor string, idle func()) {
+	lastReason := ""
+	for true {
+		if idle != nil {
+			idle()
+		}
+		if killSwitch.isPaused() {
+			if lastReason != pausedState {
+				log.Printf("Kill switch: %s is paused.\n", disruptor)
+				lastReason = pausedState
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if !testPlan.Schedule.Enabled {
+			return
+		}
+		allowed, reason := schedule.acquire(testPlan.Schedule, time.Now())
+		if allowed {
+			return
+		}
+		if reason != lastReason {
+			log.Printf("Schedule: %s is waiting, %s.\n", disruptor, reason)
+			lastReason = reason
+		}
+		time.Sleep(time.Minute)
+	}
+}
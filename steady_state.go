@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Steady state verdicts
+const (
+	steadyStateUnknown  = "unknown"
+	steadyStateSteady   = "steady"
+	steadyStateBreached = "breached"
+)
+
+// SteadyStateConfiguration is the hypothesis which must hold for every endpoint during the run
+type SteadyStateConfiguration struct {
+	MinSuccessRatio float64       `yaml:"minSuccessRatio"`
+	Window          time.Duration `yaml:"window"`
+	MaxOutage       time.Duration `yaml:"maxOutage"`
+}
+
+type steadyStateVerdict struct {
+	Verdict string   `json:"verdict"`
+	Reasons []string `json:"reasons"`
+}
+
+func withSteadyStateDefaults(config SteadyStateConfiguration) SteadyStateConfiguration {
+	if config.MinSuccessRatio <= 0 {
+		config.MinSuccessRatio = 0.95
+	}
+	if config.Window <= 0 || config.Window > maxProbeHistory*time.Second {
+		config.Window = 5 * time.Minute
+	}
+	if config.MaxOutage <= 0 {
+		config.MaxOutage = time.Minute
+	}
+	return config
+}
+
+// steadyState checks the success ratio of every endpoint and the length of its outages over the window
+func (t *eventTimeline) steadyState(config SteadyStateConfiguration, now time.Time) (verdict steadyStateVerdict) {
+	config = withSteadyStateDefaults(config)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	verdict = steadyStateVerdict{Verdict: steadyStateUnknown, Reasons: []string{}}
+	since := now.Add(-config.Window)
+	urls := []string{}
+	for url := range t.history {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		probes, failures := 0, 0
+		for _, bucket := range t.history[url] {
+			if !bucket.Time.Before(since.Truncate(time.Second)) {
+				probes += bucket.Probes
+				failures += bucket.Failures
+			}
+		}
+		if probes == 0 {
+			continue
+		}
+		verdict.Verdict = steadyStateSteady
+		ratio := float64(probes-failures) / float64(probes)
+		if ratio < config.MinSuccessRatio {
+			verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("%s succeeded in %.1f%% of the probes over %s, below %.1f%%", url, 100*ratio, config.Window, 100*config.MinSuccessRatio))
+		}
+	}
+	for _, o := range t.outages {
+		end := o.End
+		if !o.recovered() {
+			end = now
+		}
+		if end.Before(since) || end.Sub(o.Start) <= config.MaxOutage {
+			continue
+		}
+		state := "was down"
+		if !o.recovered() {
+			state = "is down"
+		}
+		verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("%s %s for %s, longer than %s", o.URL, state, end.Sub(o.Start).Round(time.Second), config.MaxOutage))
+	}
+	if len(verdict.Reasons) > 0 {
+		verdict.Verdict = steadyStateBreached
+	}
+	return verdict
+}
+
+// watchSteadyState logs every change of the steady state verdict and exposes it as a metric
+func watchSteadyState(testPlan ApplicationState) {
+	last := steadyStateUnknown
+	for true {
+		time.Sleep(time.Second)
+		verdict := timeline.steadyState(testPlan.Monitoring.SteadyState, time.Now())
+		if verdict.Verdict == last {
+			continue
+		}
+		switch verdict.Verdict {
+		case steadyStateBreached:
+			log.Printf("Steady state breached: %s.\n", strings.Join(verdict.Reasons, "; "))
+			metrics.setGauge("kube_entropy_steady_state", "Whether the steady state hypothesis holds for every endpoint.", nil, 0)
+			metrics.addCounter("kube_entropy_steady_state_breaches_total", "Number of times the steady state hypothesis was breached.", nil, 1)
+			notifySteadyState(verdict)
+		case steadyStateSteady:
+			log.Printf("Steady state holds.\n")
+			metrics.setGauge("kube_entropy_steady_state", "Whether the steady state hypothesis holds for every endpoint.", nil, 1)
+			if last == steadyStateBreached {
+				notifySteadyState(verdict)
+			}
+		}
+		last = verdict.Verdict
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Pages are touched at this stride, so allocated memory is actually resident
+const pageSize = 4096
+
+type stressLoad struct {
+	CPU      int
+	Memory   int64
+	Disk     int64
+	Duration time.Duration
+	Dir      string
+}
+
+func burnCPU(stop chan bool) {
+	for true {
+		select {
+		case <-stop:
+			return
+		default:
+			for i := 0; i < 1000000; i++ {
+			}
+		}
+	}
+}
+
+func allocateMemory(size int64) (memory []byte) {
+	memory = make([]byte, size)
+	for i := int64(0); i < size; i += pageSize {
+		memory[i] = 1
+	}
+	return memory
+}
+
+func fillDisk(fileName string, size int64) (err error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	block := make([]byte, 1024*1024)
+	for written := int64(0); written < size; {
+		chunk := int64(len(block))
+		if size-written < chunk {
+			chunk = size - written
+		}
+		n, err := file.Write(block[:chunk])
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// runStress consumes CPU, memory and disk for a duration. It backs the stress mode of the binary,
+// which is what the stress pods run, so they need no extra image.
+func runStress(load stressLoad) (err error) {
+	log.Printf("Stressing %d CPUs, %d bytes of memory and %d bytes of disk for %s.\n", load.CPU, load.Memory, load.Disk, load.Duration)
+	stop := make(chan bool)
+	defer close(stop)
+	for i := 0; i < load.CPU; i++ {
+		go burnCPU(stop)
+	}
+
+	var memory []byte
+	if load.Memory > 0 {
+		memory = allocateMemory(load.Memory)
+	}
+	if load.Disk > 0 {
+		fileName := filepath.Join(load.Dir, fmt.Sprintf("kube-entropy-stress-%d", os.Getpid()))
+		defer os.Remove(fileName)
+		err = fillDisk(fileName, load.Disk)
+		if err != nil {
+			return err
+		}
+	}
+
+	time.Sleep(load.Duration)
+	runtime.KeepAlive(memory)
+	return nil
+}
@@ -16,11 +16,14 @@ type entropySelector struct {
 }
 
 type ingressMonitoringConfig struct {
-	Selector         entropySelector `yaml:"selector"`
-	DefaultHost      string          `yaml:"defaultHost"`
-	Protocol         string          `yaml:"protocol"`
-	Port             string          `yaml:"port"`
-	SuccessHTTPCodes []string        `yaml:"successHttpCodes"`
+	Selector         entropySelector          `yaml:"selector"`
+	DefaultHost      string                   `yaml:"defaultHost"`
+	Protocol         string                   `yaml:"protocol"`
+	Port             string                   `yaml:"port"`
+	SuccessHTTPCodes []string                 `yaml:"successHttpCodes"`
+	Recovery         RecoveryConfiguration    `yaml:"recovery"`
+	Load             LoadConfiguration        `yaml:"load"`
+	SteadyState      SteadyStateConfiguration `yaml:"steadyState"`
 }
 
 type serviceMonitoringConfig struct {
@@ -39,10 +42,42 @@ type entropyConfig struct {
 	MonitoringSettings monitoringSettings `yaml:"monitoring"`
 }
 
+type podChaosConfig struct {
+	entropySelector `yaml:",inline"`
+	SafeMode        bool                `yaml:"safeMode"`
+	MinAvailable    string              `yaml:"minAvailable"`
+	Termination     TerminationStrategy `yaml:"termination"`
+	Selection       PodSelection        `yaml:"selection"`
+	Groups          []PodTargetGroup    `yaml:"groups"`
+}
+
+type nodeChaosConfig struct {
+	entropySelector `yaml:",inline"`
+	Mode            string        `yaml:"mode"`
+	Duration        time.Duration `yaml:"duration"`
+	Taint           NodeTaint     `yaml:"taint"`
+	Selection       string        `yaml:"selection"`
+	MaxPerZone      int           `yaml:"maxPerZone"`
+	CapacityGuard   bool          `yaml:"capacityGuard"`
+	MinReadyNodes   int           `yaml:"minReadyNodes"`
+	MaxPendingPods  int           `yaml:"maxPendingPods"`
+}
+
 type discoveryConfig struct {
-	Nodes   entropySelector         `yaml:"nodes"`
-	Pods    entropySelector         `yaml:"pods"`
-	Ingress ingressMonitoringConfig `yaml:"ingresses"`
+	Schedule          ScheduleConfiguration          `yaml:"schedule"`
+	KillSwitch        KillSwitchConfiguration        `yaml:"killSwitch"`
+	API               ControlAPIConfiguration        `yaml:"api"`
+	Webhooks          []WebhookConfiguration         `yaml:"webhooks"`
+	Safety            SafetyConfiguration            `yaml:"safety"`
+	Nodes             nodeChaosConfig                `yaml:"nodes"`
+	Pods              podChaosConfig                 `yaml:"pods"`
+	Workloads         WorkloadConfiguration          `yaml:"workloads"`
+	Network           NetworkConfiguration           `yaml:"network"`
+	DNS               DNSConfiguration               `yaml:"dns"`
+	Stress            StressConfiguration            `yaml:"stress"`
+	IngressController IngressControllerConfiguration `yaml:"ingressController"`
+	Proxies           []ProxyConfiguration           `yaml:"proxies"`
+	Ingress           ingressMonitoringConfig        `yaml:"ingresses"`
 }
 
 func combine(parts []string, separator string) (result string) {
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Oldest events are forgotten past this limit
+const maxTimelineEvents = 1000
+
+// Seconds of probe history kept for every endpoint
+const maxProbeHistory = 600
+
+type disruptedPod struct {
+	Name     string
+	Labels   map[string]string
+	Workload WorkloadReference
+	Node     string
+}
+
+// disruptionEvent describes what a disruption touched. Global disruptions (e.g. DNS) touch every endpoint.
+type disruptionEvent struct {
+	ID        int
+	Time      time.Time
+	Action    string
+	Namespace string
+	Pods      []disruptedPod
+	Nodes     []string
+	Workloads []WorkloadReference
+	Objects   []string
+	// URLs of the endpoints with pods on the disrupted nodes, when the disruption happened
+	Endpoints []string
+	Global    bool
+}
+
+func (disruption disruptionEvent) targets() string {
+	targets := []string{}
+	for _, pod := range disruption.Pods {
+		targets = append(targets, disruption.Namespace+"."+pod.Name)
+	}
+	targets = append(targets, disruption.Nodes...)
+	for _, workload := range disruption.Workloads {
+		targets = append(targets, disruption.Namespace+"."+workload.String())
+	}
+	return strings.Join(append(targets, disruption.Objects...), ", ")
+}
+
+// touches decides if a disruption is expected to affect an endpoint, by its pod selector, workload or node placement
+func (disruption disruptionEvent) touches(endpoint EndpointState) bool {
+	if disruption.Global {
+		return true
+	}
+	for _, pod := range disruption.Pods {
+		if endpoint.Namespace != "" && endpoint.Namespace != disruption.Namespace {
+			continue
+		}
+		if endpoint.Workload.Name != "" && endpoint.Workload == pod.Workload {
+			return true
+		}
+		if len(endpoint.PodSelector) > 0 && labels.SelectorFromSet(endpoint.PodSelector).Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	for _, workload := range disruption.Workloads {
+		if endpoint.Workload == workload && (endpoint.Namespace == "" || endpoint.Namespace == disruption.Namespace) {
+			return true
+		}
+	}
+	if disruption.Endpoints != nil {
+		return containsString(disruption.Endpoints, endpoint.URL)
+	}
+	for _, node := range disruption.Nodes {
+		if containsString(endpoint.Topology.nodes(), node) {
+			return true
+		}
+	}
+	return false
+}
+
+type outage struct {
+	Ingress      string
+	URL          string
+	DisruptionID int
+	Start        time.Time
+	End          time.Time
+	Failures     int
+}
+
+func (o outage) recovered() bool {
+	return !o.End.IsZero()
+}
+
+// probeResult is the latest probe of an endpoint, by any of the monitors
+type probeResult struct {
+	Ingress  string    `json:"ingress"`
+	URL      string    `json:"url"`
+	Time     time.Time `json:"time"`
+	Success  bool      `json:"success"`
+	Probes   int       `json:"probes"`
+	Failures int       `json:"failures"`
+}
+
+// probeBucket counts the probes of an endpoint within one second
+type probeBucket struct {
+	Time     time.Time `json:"time"`
+	Probes   int       `json:"probes"`
+	Failures int       `json:"failures"`
+}
+
+type eventTimeline struct {
+	lock        sync.Mutex
+	disruptions []disruptionEvent
+	outages     []*outage
+	open        map[string]*outage
+	latest      map[string]*probeResult
+	history     map[string][]probeBucket
+	// Outages starting later than this after a disruption aren't attributed to it, the recovery timeout by default
+	attributionWindow time.Duration
+}
+
+var timeline = eventTimeline{open: map[string]*outage{}}
+
+func (t *eventTimeline) recordDisruption(disruption disruptionEvent) disruptionEvent {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	disruption.ID = 1
+	if len(t.disruptions) > 0 {
+		disruption.ID = t.disruptions[len(t.disruptions)-1].ID + 1
+	}
+	disruption.Time = time.Now()
+	t.disruptions = append(t.disruptions, disruption)
+	if len(t.disruptions) > maxTimelineEvents {
+		t.disruptions = t.disruptions[1:]
+	}
+	return disruption
+}
+
+// recordProbe tracks the outages of an endpoint and attributes each one to the most recent disruption touching it,
+// unless that disruption is older than the attribution window
+func (t *eventTimeline) recordProbe(ingress IngressState, endpoint EndpointState, success bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.latest == nil {
+		t.latest, t.history = map[string]*probeResult{}, map[string][]probeBucket{}
+	}
+	result, found := t.latest[endpoint.URL]
+	if !found {
+		result = &probeResult{Ingress: ingress.Namespace + "." + ingress.Name, URL: endpoint.URL}
+		t.latest[endpoint.URL] = result
+	}
+	result.Time, result.Success = time.Now(), success
+	result.Probes++
+	buckets := t.history[endpoint.URL]
+	if second := result.Time.Truncate(time.Second); len(buckets) == 0 || !buckets[len(buckets)-1].Time.Equal(second) {
+		buckets = append(buckets, probeBucket{Time: second})
+		if len(buckets) > maxProbeHistory {
+			buckets = buckets[1:]
+		}
+	}
+	buckets[len(buckets)-1].Probes++
+	if !success {
+		result.Failures++
+		buckets[len(buckets)-1].Failures++
+	}
+	t.history[endpoint.URL] = buckets
+
+	current, down := t.open[endpoint.URL]
+	if success {
+		if down {
+			current.End = time.Now()
+			delete(t.open, endpoint.URL)
+			notifyOutage(*current)
+		}
+		return
+	}
+	if down {
+		current.Failures++
+		return
+	}
+
+	current = &outage{Ingress: ingress.Namespace + "." + ingress.Name, URL: endpoint.URL, Start: time.Now(), Failures: 1}
+	window := t.attributionWindow
+	if window <= 0 {
+		window = withRecoveryDefaults(RecoveryConfiguration{}).Timeout
+	}
+	for i := len(t.disruptions) - 1; i >= 0; i-- {
+		if current.Start.Sub(t.disruptions[i].Time) > window {
+			break
+		}
+		if t.disruptions[i].touches(endpoint) {
+			current.DisruptionID = t.disruptions[i].ID
+			break
+		}
+	}
+	t.open[endpoint.URL] = current
+	t.outages = append(t.outages, current)
+	if len(t.outages) > maxTimelineEvents {
+		t.outages = t.outages[1:]
+	}
+	notifyOutage(*current)
+}
+
+// probeResults returns the latest probe of every endpoint, sorted by URL
+func (t *eventTimeline) probeResults() (results []probeResult) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	results = []probeResult{}
+	for _, result := range t.latest {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].URL < results[j].URL })
+	return results
+}
+
+// summary counts the disruptions and outages of the run
+func (t *eventTimeline) summary() (disruptions int, outages int, unrecovered int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, o := range t.outages {
+		if !o.recovered() {
+			unrecovered++
+		}
+	}
+	return len(t.disruptions), len(t.outages), unrecovered
+}
+
+func describeOutage(o outage) string {
+	if o.recovered() {
+		return fmt.Sprintf("%s (%s) recovered after %s, %d failed probes", o.URL, o.Ingress, o.End.Sub(o.Start).Round(time.Millisecond), o.Failures)
+	}
+	return fmt.Sprintf("%s (%s) not recovered after %s, %d failed probes", o.URL, o.Ingress, time.Since(o.Start).Round(time.Millisecond), o.Failures)
+}
+
+// printReport lists every disruption with the endpoints it affected and their time to recovery
+func (t *eventTimeline) printReport(out io.Writer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	fmt.Fprintf(out, "Disruption report\n")
+	for _, disruption := range t.disruptions {
+		fmt.Fprintf(out, "%s %s %s\n", disruption.Time.Format(time.RFC3339), disruption.Action, disruption.targets())
+		affected := 0
+		for _, o := range t.outages {
+			if o.DisruptionID == disruption.ID {
+				fmt.Fprintf(out, "  -> %s\n", describeOutage(*o))
+				affected++
+			}
+		}
+		if affected == 0 {
+			fmt.Fprintf(out, "  -> no endpoints affected\n")
+		}
+	}
+
+	unattributed := []string{}
+	for _, o := range t.outages {
+		if o.DisruptionID == 0 {
+			unattributed = append(unattributed, describeOutage(*o))
+		}
+	}
+	if len(unattributed) > 0 {
+		fmt.Fprintf(out, "Failures not attributed to a disruption\n")
+		for _, description := range unattributed {
+			fmt.Fprintf(out, "  -> %s\n", description)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type PodTopology struct {
+	Name          string              `yaml:"name"`
+	Node          string              `yaml:"node"`
+	EndpointSlice string              `yaml:"endpointSlice"`
+	Owners        []WorkloadReference `yaml:"owners"`
+}
+
+// EndpointTopology is the chain behind an ingress route: Service -> EndpointSlices -> Pods -> Workloads -> Nodes
+type EndpointTopology struct {
+	Service string        `yaml:"service"`
+	Pods    []PodTopology `yaml:"pods"`
+}
+
+func (topology EndpointTopology) nodes() (nodes []string) {
+	for _, pod := range topology.Pods {
+		if pod.Node != "" && !containsString(nodes, pod.Node) {
+			nodes = append(nodes, pod.Node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// workload is the top level workload running most of the pods
+func (topology EndpointTopology) workload() (workload WorkloadReference) {
+	counts := map[WorkloadReference]int{}
+	for _, pod := range topology.Pods {
+		if len(pod.Owners) == 0 {
+			continue
+		}
+		podWorkload := pod.Owners[len(pod.Owners)-1]
+		counts[podWorkload]++
+		if counts[podWorkload] > counts[workload] {
+			workload = podWorkload
+		}
+	}
+	return workload
+}
+
+func discoverTopology(ctx context.Context, clientset *kubernetes.Clientset, namespace string, serviceName string) (topology EndpointTopology) {
+	topology.Service = serviceName
+	slices, err := clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{LabelSelector: "kubernetes.io/service-name=" + serviceName})
+	if err != nil {
+		log.Printf("Cannot get endpoint slices of %s.%s: %v\n", namespace, serviceName, err)
+		return topology
+	}
+
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+				continue
+			}
+			podTopology := PodTopology{Name: endpoint.TargetRef.Name, EndpointSlice: slice.Name}
+			if endpoint.NodeName != nil {
+				podTopology.Node = *endpoint.NodeName
+			}
+			pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podTopology.Name, metav1.GetOptions{})
+			if err != nil {
+				log.Printf("Cannot get pod %s.%s: %v\n", namespace, podTopology.Name, err)
+			} else {
+				if podTopology.Node == "" {
+					podTopology.Node = pod.Spec.NodeName
+				}
+				podTopology.Owners, err = resolveOwners(ctx, clientset, pod.Namespace, pod.OwnerReferences)
+				if err != nil {
+					log.Printf("Cannot resolve the owners of %s.%s: %v\n", namespace, podTopology.Name, err)
+				}
+			}
+			topology.Pods = append(topology.Pods, podTopology)
+		}
+	}
+	return topology
+}
+
+// resolveOwners follows the controller references up to the top level workload, e.g. ReplicaSet -> Deployment
+func resolveOwners(ctx context.Context, clientset *kubernetes.Clientset, namespace string, references []metav1.OwnerReference) (owners []WorkloadReference, err error) {
+	owner := controllerOf(references)
+	for owner != nil {
+		owners = append(owners, WorkloadReference{Kind: owner.Kind, Name: owner.Name})
+		if owner.Kind != "ReplicaSet" {
+			break
+		}
+		replicaSet, err := clientset.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return owners, err
+		}
+		owner = metav1.GetControllerOf(replicaSet)
+	}
+	return owners, nil
+}
+
+// resolveWorkload finds the top level workload of a pod
+func resolveWorkload(ctx context.Context, clientset *kubernetes.Clientset, pod v1.Pod) (workload WorkloadReference, err error) {
+	owners, err := resolveOwners(ctx, clientset, pod.Namespace, pod.OwnerReferences)
+	if err != nil {
+		return workload, err
+	}
+	if len(owners) == 0 {
+		return WorkloadReference{Kind: "Pod", Name: pod.Name}, nil
+	}
+	return owners[len(owners)-1], nil
+}
+
+func controllerOf(references []metav1.OwnerReference) *metav1.OwnerReference {
+	for i := range references {
+		if references[i].Controller != nil && *references[i].Controller {
+			return &references[i]
+		}
+	}
+	return nil
+}
+
+// livePlacement maps every endpoint to the nodes its pods run on now. Pods are rescheduled by every
+// disruption, so the topology recorded at discovery is only used when the pods can't be listed.
+func livePlacement(ctx context.Context, clientset *kubernetes.Clientset, testPlan ApplicationState) (placement map[string][]string) {
+	placement = map[string][]string{}
+	// Endpoints of the same workload share their pods, which are listed once
+	listed := map[string][]string{}
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		for _, endpoint := range ingress.Endpoints {
+			placement[endpoint.URL] = endpoint.Topology.nodes()
+			// Older test plans have no endpoint namespace recorded, and an empty one would list the pods of every namespace
+			namespace := endpoint.Namespace
+			if namespace == "" {
+				namespace = ingress.Namespace
+			}
+			if len(endpoint.PodSelector) == 0 || namespace == "" {
+				continue
+			}
+			listOptions := labelSelectors(endpoint.PodSelector)
+			key := namespace + "/" + listOptions.LabelSelector
+			if nodes, found := listed[key]; found {
+				placement[endpoint.URL] = nodes
+				continue
+			}
+			pods, err := clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+			if err != nil {
+				log.Printf("ERROR: Cannot get the pods of %s, using the discovered topology: %v\n", endpoint.URL, err)
+				continue
+			}
+			nodes := []string{}
+			for _, pod := range pods.Items {
+				if pod.Spec.NodeName != "" && pod.DeletionTimestamp == nil && !containsString(nodes, pod.Spec.NodeName) {
+					nodes = append(nodes, pod.Spec.NodeName)
+				}
+			}
+			listed[key], placement[endpoint.URL] = nodes, nodes
+		}
+	}
+	return placement
+}
+
+// routesOnNode lists the routes expected to be affected when a node goes away, by the placement of their pods,
+// or by the discovered topology without one
+func routesOnNode(testPlan ApplicationState, placement map[string][]string, node string) (routes []string) {
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		for _, endpoint := range ingress.Endpoints {
+			nodes, found := placement[endpoint.URL]
+			if !found {
+				nodes = endpoint.Topology.nodes()
+			}
+			if containsString(nodes, node) {
+				routes = append(routes, endpoint.URL)
+			}
+		}
+	}
+	return routes
+}
+
+// routesOfWorkload lists the routes expected to be affected when pods of a workload go away
+func routesOfWorkload(testPlan ApplicationState, namespace string, workload WorkloadReference) (routes []string) {
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		for _, endpoint := range ingress.Endpoints {
+			if endpoint.Namespace == namespace && endpoint.Workload == workload {
+				routes = append(routes, endpoint.URL)
+			}
+		}
+	}
+	return routes
+}
+
+func printTopologyTree(testPlan ApplicationState, out io.Writer) {
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		fmt.Fprintf(out, "ingress %s.%s\n", ingress.Namespace, ingress.Name)
+		for _, endpoint := range ingress.Endpoints {
+			fmt.Fprintf(out, "  route %s\n", endpoint.URL)
+			fmt.Fprintf(out, "    service %s\n", endpoint.Topology.Service)
+			for _, pod := range endpoint.Topology.Pods {
+				owners := []string{}
+				for _, owner := range pod.Owners {
+					owners = append(owners, owner.String())
+				}
+				fmt.Fprintf(out, "      endpointslice %s -> pod %s -> %s -> node %s\n", pod.EndpointSlice, pod.Name, strings.Join(owners, " -> "), pod.Node)
+			}
+		}
+	}
+}
+
+func printTopologyDot(testPlan ApplicationState, out io.Writer) {
+	edges := []string{}
+	seen := map[string]bool{}
+	addEdge := func(from string, to string) {
+		edge := fmt.Sprintf("  %q -> %q;", from, to)
+		if !seen[edge] {
+			seen[edge] = true
+			edges = append(edges, edge)
+		}
+	}
+
+	for _, ingress := range testPlan.Monitoring.Ingresses.Items {
+		ingressNode := "ingress " + ingress.Namespace + "." + ingress.Name
+		for _, endpoint := range ingress.Endpoints {
+			serviceNode := "service " + ingress.Namespace + "." + endpoint.Topology.Service
+			addEdge(ingressNode, endpoint.URL)
+			addEdge(endpoint.URL, serviceNode)
+			for _, pod := range endpoint.Topology.Pods {
+				sliceNode := "endpointslice " + pod.EndpointSlice
+				podNode := "pod " + pod.Name
+				addEdge(serviceNode, sliceNode)
+				addEdge(sliceNode, podNode)
+				previous := podNode
+				for _, owner := range pod.Owners {
+					addEdge(previous, owner.String())
+					previous = owner.String()
+				}
+				if pod.Node != "" {
+					addEdge(podNode, "node "+pod.Node)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "digraph topology {\n  rankdir=LR;\n%s\n}\n", strings.Join(edges, "\n"))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Events sent to webhooks
+const (
+	eventRunStarted          = "run_started"
+	eventRunFinished         = "run_finished"
+	eventDisruption          = "disruption"
+	eventEndpointDown        = "endpoint_down"
+	eventEndpointRecovered   = "endpoint_recovered"
+	eventSteadyStateBreached = "steady_state_breached"
+	eventSteadyStateRestored = "steady_state_restored"
+)
+
+// Webhook payload formats
+const (
+	webhookGeneric = "generic"
+	webhookSlack   = "slack"
+)
+
+// Notifications waiting for delivery to a webhook, newer ones are dropped past this limit
+const webhookQueueSize = 100
+
+// WebhookConfiguration is part of the test plan served by the control API, so the URL and headers, which usually
+// carry credentials, are never serialized to JSON. They are best read from a file (e.g. a mounted Secret) or the environment.
+type WebhookConfiguration struct {
+	Name        string            `yaml:"name"`
+	URL         string            `yaml:"url" json:"-"`
+	URLFile     string            `yaml:"urlFile"`
+	URLEnv      string            `yaml:"urlEnv"`
+	Format      string            `yaml:"format"`
+	Events      []string          `yaml:"events"`
+	Template    string            `yaml:"template"`
+	Headers     map[string]string `yaml:"headers" json:"-"`
+	HeaderFiles map[string]string `yaml:"headerFiles"`
+	HeaderEnv   map[string]string `yaml:"headerEnv"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	Retries     int               `yaml:"retries"`
+	Backoff     time.Duration     `yaml:"backoff"`
+}
+
+type notification struct {
+	Event   string            `json:"event"`
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"`
+	Data    map[string]string `json:"data"`
+}
+
+type webhookNotifier struct {
+	config   WebhookConfiguration
+	template *template.Template
+	client   *http.Client
+	queue    chan notification
+	done     chan bool
+}
+
+var webhooks []*webhookNotifier
+var webhooksLock sync.RWMutex
+
+// readSecret reads a secret value from a file, or from an environment variable
+func readSecret(fileName string, variable string) (value string, err error) {
+	if fileName != "" {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	value = os.Getenv(variable)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is empty", variable)
+	}
+	return value, nil
+}
+
+// withWebhookSecrets resolves the URL and headers read from files or environment variables
+func withWebhookSecrets(config WebhookConfiguration) (WebhookConfiguration, error) {
+	if config.URLFile != "" || config.URLEnv != "" {
+		value, err := readSecret(config.URLFile, config.URLEnv)
+		if err != nil {
+			return config, fmt.Errorf("cannot read the webhook url: %v", err)
+		}
+		config.URL = value
+	}
+	headers := map[string]string{}
+	for name, value := range config.Headers {
+		headers[name] = value
+	}
+	for name, fileName := range config.HeaderFiles {
+		value, err := readSecret(fileName, "")
+		if err != nil {
+			return config, fmt.Errorf("cannot read the webhook header %s: %v", name, err)
+		}
+		headers[name] = value
+	}
+	for name, variable := range config.HeaderEnv {
+		value, err := readSecret("", variable)
+		if err != nil {
+			return config, fmt.Errorf("cannot read the webhook header %s: %v", name, err)
+		}
+		headers[name] = value
+	}
+	config.Headers = headers
+	if config.URL == "" {
+		return config, fmt.Errorf("webhook has no url")
+	}
+	return config, nil
+}
+
+func withWebhookDefaults(config WebhookConfiguration) WebhookConfiguration {
+	// The URL may carry a token, only its host is logged
+	if parsed, err := url.Parse(config.URL); config.Name == "" && err == nil {
+		config.Name = parsed.Host
+	}
+	if config.Format == "" {
+		config.Format = webhookGeneric
+	}
+	if config.Template == "" {
+		config.Template = "{{.Message}}"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Retries <= 0 {
+		config.Retries = 3
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = time.Second
+	}
+	return config
+}
+
+func newWebhookNotifier(config WebhookConfiguration) (notifier *webhookNotifier, err error) {
+	config, err = withWebhookSecrets(config)
+	if err != nil {
+		return nil, err
+	}
+	config = withWebhookDefaults(config)
+	if config.Format != webhookGeneric && config.Format != webhookSlack {
+		return nil, fmt.Errorf("webhook %s has an unknown format %s", config.Name, config.Format)
+	}
+	messageTemplate, err := template.New(config.Name).Option("missingkey=zero").Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s has an invalid template: %v", config.Name, err)
+	}
+	return &webhookNotifier{config: config, template: messageTemplate, client: &http.Client{Timeout: config.Timeout},
+		queue: make(chan notification, webhookQueueSize), done: make(chan bool)}, nil
+}
+
+func (notifier *webhookNotifier) accepts(event string) bool {
+	return len(notifier.config.Events) == 0 || containsString(notifier.config.Events, event)
+}
+
+// payload renders the message template into a Slack compatible or a generic JSON body
+func (notifier *webhookNotifier) payload(event notification) (body []byte, err error) {
+	var message bytes.Buffer
+	err = notifier.template.Execute(&message, event)
+	if err != nil {
+		return nil, err
+	}
+	event.Message = message.String()
+	if notifier.config.Format == webhookSlack {
+		return json.Marshal(map[string]string{"text": event.Message})
+	}
+	return json.Marshal(event)
+}
+
+func (notifier *webhookNotifier) post(body []byte) (retry bool, err error) {
+	request, err := http.NewRequest(http.MethodPost, notifier.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range notifier.config.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		// Client errors other than rate limiting won't go away by retrying
+		return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500, fmt.Errorf("status %s", response.Status)
+	}
+	return false, nil
+}
+
+// deliver posts a notification, retrying with an exponential backoff
+func (notifier *webhookNotifier) deliver(event notification) {
+	body, err := notifier.payload(event)
+	if err != nil {
+		log.Printf("ERROR: Cannot render the %s notification for webhook %s: %v\n", event.Event, notifier.config.Name, err)
+		return
+	}
+	backoff := notifier.config.Backoff
+	for attempt := 0; attempt <= notifier.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		retry, err := notifier.post(body)
+		if err == nil {
+			return
+		}
+		log.Printf("ERROR: Cannot post the %s notification to webhook %s (attempt %d): %v\n", event.Event, notifier.config.Name, attempt+1, err)
+		if !retry {
+			break
+		}
+	}
+	metrics.addCounter("kube_entropy_webhook_failures_total", "Notifications which couldn't be delivered to a webhook.", map[string]string{"webhook": notifier.config.Name}, 1)
+}
+
+func (notifier *webhookNotifier) run() {
+	defer close(notifier.done)
+	for event := range notifier.queue {
+		notifier.deliver(event)
+	}
+}
+
+func startWebhooks(configs []WebhookConfiguration) (err error) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for i, config := range configs {
+		notifier, err := newWebhookNotifier(config)
+		if err != nil {
+			return fmt.Errorf("webhooks[%d]: %v", i, err)
+		}
+		log.Printf("Sending notifications to webhook %s.\n", notifier.config.Name)
+		webhooks = append(webhooks, notifier)
+		go notifier.run()
+	}
+	return nil
+}
+
+// notify queues a notification for every webhook interested in the event, without ever blocking the caller
+func notify(event string, message string, data map[string]string) {
+	webhooksLock.RLock()
+	defer webhooksLock.RUnlock()
+	for _, notifier := range webhooks {
+		if !notifier.accepts(event) {
+			continue
+		}
+		select {
+		case notifier.queue <- notification{Event: event, Time: time.Now(), Message: message, Data: data}:
+		default:
+			log.Printf("ERROR: Webhook %s is falling behind, dropping the %s notification.\n", notifier.config.Name, event)
+		}
+	}
+}
+
+// stopWebhooks delivers the queued notifications, waiting at most for the timeout
+func stopWebhooks(timeout time.Duration) {
+	webhooksLock.Lock()
+	stopped := webhooks
+	webhooks = nil
+	webhooksLock.Unlock()
+
+	deadline := time.After(timeout)
+	for _, notifier := range stopped {
+		close(notifier.queue)
+	}
+	for _, notifier := range stopped {
+		select {
+		case <-notifier.done:
+		case <-deadline:
+			log.Printf("ERROR: Webhook %s didn't deliver every notification in time.\n", notifier.config.Name)
+			return
+		}
+	}
+}
+
+func notifyDisruption(disruption disruptionEvent) {
+	data := map[string]string{"id": fmt.Sprint(disruption.ID), "action": disruption.Action, "namespace": disruption.Namespace,
+		"targets": disruption.targets(), "global": fmt.Sprint(disruption.Global)}
+	notify(eventDisruption, fmt.Sprintf("Disruption #%d: %s %s", disruption.ID, disruption.Action, disruption.targets()), data)
+}
+
+func notifyOutage(o outage) {
+	data := map[string]string{"ingress": o.Ingress, "url": o.URL, "disruption": fmt.Sprint(o.DisruptionID), "failures": fmt.Sprint(o.Failures)}
+	if o.recovered() {
+		data["outage"] = o.End.Sub(o.Start).Round(time.Millisecond).String()
+		notify(eventEndpointRecovered, describeOutage(o), data)
+		return
+	}
+	message := fmt.Sprintf("%s (%s) is down", o.URL, o.Ingress)
+	if o.DisruptionID > 0 {
+		message += fmt.Sprintf(" after disruption #%d", o.DisruptionID)
+	}
+	notify(eventEndpointDown, message, data)
+}
+
+func notifySteadyState(verdict steadyStateVerdict) {
+	if verdict.Verdict == steadyStateBreached {
+		notify(eventSteadyStateBreached, "Steady state breached: "+strings.Join(verdict.Reasons, "; "), map[string]string{"reasons": strings.Join(verdict.Reasons, "\n")})
+		return
+	}
+	notify(eventSteadyStateRestored, "Steady state holds again", map[string]string{})
+}